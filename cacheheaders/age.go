@@ -0,0 +1,68 @@
+package cacheheaders
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expiredDate - The Expires value of responses that must not be reused by HTTP/1.0 caches
+var expiredDate = time.Unix(0, 0).UTC().Format(http.TimeFormat)
+
+// Clock - The source of the current time for generated Expires and Age headers. Tests can inject a fixed clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc - Adapts an ordinary function to the Clock interface, eg. `ClockFunc(time.Now)`
+type ClockFunc func() time.Time
+
+// Now - Implements the Clock interface
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// systemClock - The default Clock
+var systemClock = ClockFunc(time.Now)
+
+// CurrentAge - Computes the age of a stored response, as described in RFC 9111 section 4.2.3.
+// h holds the response headers as received (with their Date and Age headers, if any),
+// requestTime and responseTime are the times the request was sent and the response received, and now is the current time.
+func CurrentAge(h http.Header, requestTime, responseTime, now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(h.Get("Date")); err == nil && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+
+	ageValue := time.Duration(0)
+	if seconds, err := strconv.ParseInt(strings.TrimSpace(h.Get("Age")), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+
+	responseDelay := responseTime.Sub(requestTime)
+	if responseDelay < 0 {
+		responseDelay = 0
+	}
+
+	correctedInitialAge := ageValue + responseDelay
+	if apparentAge > correctedInitialAge {
+		correctedInitialAge = apparentAge
+	}
+
+	residentTime := now.Sub(responseTime)
+	if residentTime < 0 {
+		residentTime = 0
+	}
+
+	return correctedInitialAge + residentTime
+}
+
+// SetAge - Sets the Age header to a duration, in whole seconds
+func SetAge(h http.Header, age time.Duration) {
+	if age < 0 {
+		age = 0
+	}
+
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
@@ -0,0 +1,112 @@
+package cacheheaders
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCurrentAge(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return base.Add(time.Duration(seconds) * time.Second)
+	}
+
+	tests := []struct {
+		name     string
+		date     time.Time
+		age      string
+		request  time.Time
+		response time.Time
+		now      time.Time
+		expected time.Duration
+	}{
+		{"fresh from origin", at(0), "", at(0), at(0), at(0), 0},
+		{"apparent age", at(0), "", at(10), at(10), at(10), 10 * time.Second},
+		{"age header plus delay", at(10), "30", at(8), at(10), at(10), 32 * time.Second},
+		{"resident time", at(0), "5", at(0), at(0), at(60), 65 * time.Second},
+		{"clock skew", at(100), "", at(0), at(0), at(0), 0},
+		{"no date", time.Time{}, "20", at(0), at(1), at(1), 21 * time.Second},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		if !tt.date.IsZero() {
+			h.Set("Date", tt.date.Format(http.TimeFormat))
+		}
+		if tt.age != "" {
+			h.Set("Age", tt.age)
+		}
+
+		if got := CurrentAge(h, tt.request, tt.response, tt.now); got != tt.expected {
+			t.Errorf("%s: Age mismatch!\nExpected: %v\nGot     : %v\n", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestExpiresAndAge(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := ClockFunc(func() time.Time { return now })
+
+	get := func(cc *CacheControl, upstream http.Header, authorization bool) http.Header {
+		handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range upstream {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		request := httptest.NewRequest("GET", "/", nil)
+		if authorization {
+			request.Header.Set("Authorization", "Bearer token")
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		return recorder.Header()
+	}
+
+	cc := &CacheControl{Expires: true, Age: true, Clock: clock}
+	cc.SetMaxAge(60)
+
+	// generated by the handler: no Age
+	h := get(cc, nil, false)
+	if got, expected := h.Get("Expires"), "Fri, 01 Mar 2024 12:01:00 GMT"; got != expected {
+		t.Errorf("Expires header mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+	if got := h.Get("Age"); got != "" {
+		t.Errorf("Expected no Age header for a fresh response, got %q", got)
+	}
+
+	// proxied from an upstream cache: the age shortens the expiry
+	upstream := http.Header{"Date": {now.Add(-5 * time.Second).Format(http.TimeFormat)}, "Age": {"15"}}
+	h = get(cc, upstream, false)
+	if got, expected := h.Get("Age"), "15"; got != expected {
+		t.Errorf("Age header mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+	if got, expected := h.Get("Expires"), "Fri, 01 Mar 2024 12:00:45 GMT"; got != expected {
+		t.Errorf("Expires header mismatch for a proxied response!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+
+	// responses that HTTP/1.0 caches must not reuse expire in the past
+	private := &CacheControl{Private: true, Expires: true, Clock: clock}
+	private.SetMaxAge(60)
+
+	for name, h := range map[string]http.Header{
+		"private":    get(private, nil, false),
+		"no-store":   get(&CacheControl{NoStore: true, Expires: true, Clock: clock}, nil, false),
+		"downgraded": get(cc, nil, true),
+	} {
+		if got := h.Get("Expires"); got != expiredDate {
+			t.Errorf("%s: Expires header mismatch!\nExpected: %v\nGot     : %v\n", name, expiredDate, got)
+		}
+	}
+
+	// an Expires header set by the handler is left alone
+	h = get(cc, http.Header{"Expires": {"0"}}, false)
+	if got := h.Get("Expires"); got != "0" {
+		t.Errorf("Expected the handler's Expires header to be kept, got %q", got)
+	}
+}
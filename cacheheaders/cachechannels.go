@@ -1,10 +1,11 @@
 package cacheheaders
 
 import (
-	"log"
+	"context"
 	"net/http"
 	"regexp"
-	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // X-Cache-Channel: Used by Varnish
@@ -13,46 +14,219 @@ const CacheChannelHeader = "X-Cache-Channel"
 // Cache-Tag: Used by Cloudflare (Enterprise only)
 const CacheTagHeader = "Cache-Tag"
 
+// illegalChannelChars - matches any character that's not in the legal range: a-z, A-Z, 0-9, _, -
+var illegalChannelChars = regexp.MustCompile(`[^\w-]+`)
+
 // CacheChannels - A middleware struct that outputs cache channel / cache tag headers
 // These headers can be used by cache proxies to ban / invalidate large groups of cached items in one go
+// Each CDN gets the channels in its own header, formatted according to its Dialect.
 type CacheChannels struct {
-	Varnish    bool // if true, SendHeaders() will send the Varnish "X-Cache-Channel" header
-	Cloudflare bool // if true, SendHeaders() will send the Cloudflare Enterprise "Cache-Tag" header
-	channels   []string
+	Varnish    bool      // if true, SendHeaders() will send the Varnish "X-Cache-Channel" header (same as adding VarnishDialect to Dialects)
+	Cloudflare bool      // if true, SendHeaders() will send the Cloudflare Enterprise "Cache-Tag" header (same as adding CloudflareDialect to Dialects)
+	Dialects   []Dialect // additional CDN dialects to send headers for, eg. FastlyDialect, AkamaiDialect or a custom one
+
+	// OnOverflow - Optional. Called whenever the channels of a response had to be altered to fit the limits of a dialect,
+	// eg. to log a warning or increment an alert metric. See Overflow.
+	// Channels are prioritised in the order they were added (static channels first), so the last ones are dropped first.
+	OnOverflow func(r *http.Request, o Overflow)
+
+	Metrics Metrics // optional. Observes the number of channels per response.
+
+	// Naming - optional. Namespacing, hierarchical levels and non-ASCII handling of the channels, see ChannelNaming.
+	// Set it before calling Add / Set. Request-scoped channels are named by the outermost CacheChannels.
+	Naming ChannelNaming
+
+	mu       sync.Mutex   // serializes Add and Set
+	channels atomic.Value // []string, replaced as a whole by Add and Set so that requests in flight can keep reading the old one
 }
 
 // Add - Prunes, then adds the specified channels to the channel slice
-// Removes any character that's not in the legal range: a-z, A-Z, 0-9, _, -
+// Transliterates non-ASCII characters, and removes any other character that's not in the legal range: a-z, A-Z, 0-9, _, - (see ChannelNaming)
+// Safe to call while the CacheChannels is serving requests.
 func (cc *CacheChannels) Add(channels ...string) {
-	rx, err := regexp.Compile(`[^\w-]+`)
-	if err != nil { // shouldn't ever happen (but still)
-		log.Printf("Regex compile error: %s", err.Error())
-		return
-	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
 
+	current := cc.Channels()
+	updated := make([]string, 0, len(current)+len(channels))
+	updated = append(updated, current...)
 	for _, ch := range channels {
-		cc.channels = append(cc.channels, rx.ReplaceAllString(ch, ""))
+		updated = append(updated, cc.Naming.channels(ch)...)
 	}
+
+	cc.channels.Store(updated)
 }
 
 // Set - Replaces any existing channels, with the specified channels
+// Safe to call while the CacheChannels is serving requests.
 func (cc *CacheChannels) Set(channels ...string) {
-	cc.channels = []string{}
-	cc.Add(channels...)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	updated := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		updated = append(updated, cc.Naming.channels(ch)...)
+	}
+
+	cc.channels.Store(updated)
+}
+
+// Channels - Returns the static channels. The returned slice must not be modified.
+func (cc *CacheChannels) Channels() []string {
+	channels, _ := cc.channels.Load().([]string)
+	return channels
 }
 
 // SendHeaders - A middleware function compatible with most routers
-// Sends the configured cache channels as "X-Cache-Channel" headers
+// Sends the configured cache channels as "X-Cache-Channel" / "Cache-Tag" / dialect-specific headers,
+// along with any request-scoped channels added by the handler through AddChannels.
+// The headers are written when the response starts, ie. on the first WriteHeader / Write.
 func (cc *CacheChannels) SendHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if cc.Varnish {
-			w.Header().Set(CacheChannelHeader, strings.Join(cc.channels, ", "))
+		col, ok := r.Context().Value(channelCollectorKey{}).(*channelCollector)
+		if !ok {
+			col = &channelCollector{}
+			r = r.WithContext(context.WithValue(r.Context(), channelCollectorKey{}, col))
 		}
 
-		if cc.Cloudflare {
-			w.Header().Set(CacheTagHeader, strings.Join(cc.channels, ","))
-		}
+		// nested CacheChannels middlewares share one collector,
+		// so that the outermost one ends up sending the channels of every layer
+		col.useNaming(cc.Naming)
+		col.add(cc.Channels()...)
+
+		hw := &headerWriter{ResponseWriter: w, before: func(h http.Header, status int) {
+			cc.writeHeaders(r, h, status, col.list())
+		}}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(hw, r)
+		hw.finalize(http.StatusOK) // the handler might not have written anything
 	})
 }
+
+// writeHeaders - Writes the channel headers of every dialect that is enabled on the CacheChannels config
+func (cc *CacheChannels) writeHeaders(r *http.Request, h http.Header, status int, channels []string) {
+	if cc.Metrics != nil {
+		cc.Metrics.ObserveChannels(len(channels), statusClass(status))
+	}
+
+	info := debugInfoFrom(r.Context())
+	if info != nil {
+		info.recordChannels(channels)
+	}
+
+	for _, d := range cc.dialects() {
+		tags, overflows := formatTags(d, channels)
+		if tags != "" {
+			h.Set(d.Header(), tags)
+		}
+
+		if info != nil {
+			info.recordOverflows(overflows)
+		}
+
+		if cc.OnOverflow != nil {
+			for _, o := range overflows {
+				cc.OnOverflow(r, o)
+			}
+		}
+	}
+}
+
+// dialects - Returns the enabled dialects, including the ones enabled through the Varnish and Cloudflare booleans
+func (cc *CacheChannels) dialects() []Dialect {
+	dialects := make([]Dialect, 0, len(cc.Dialects)+2)
+	if cc.Varnish {
+		dialects = append(dialects, VarnishDialect)
+	}
+
+	if cc.Cloudflare {
+		dialects = append(dialects, CloudflareDialect)
+	}
+
+	return append(dialects, cc.Dialects...)
+}
+
+// AddChannels - Adds request-scoped cache channels from within a handler,
+// eg. `cacheheaders.AddChannels(r.Context(), "article-123", "section-sport")`.
+// The channels are named the same way as by CacheChannels.Add (of the outermost CacheChannels), and sent along with the static channels.
+// Returns false if the request didn't pass through the CacheChannels.SendHeaders middleware.
+func AddChannels(ctx context.Context, channels ...string) bool {
+	col, ok := ctx.Value(channelCollectorKey{}).(*channelCollector)
+	if !ok {
+		return false
+	}
+
+	col.add(col.name(channels)...)
+	return true
+}
+
+// pruneChannel - Removes any character that's not in the legal range: a-z, A-Z, 0-9, _, -
+func pruneChannel(ch string) string {
+	return illegalChannelChars.ReplaceAllString(ch, "")
+}
+
+// channelCollectorKey - The context key of the request-scoped channel collector
+type channelCollectorKey struct{}
+
+// channelCollector - Collects the cache channels of a single request.
+// Safe for concurrent use, as handlers may add channels from several goroutines.
+type channelCollector struct {
+	mu       sync.Mutex
+	naming   *ChannelNaming // the naming of request-scoped channels, set by the first CacheChannels to see the collector
+	channels []string
+	seen     map[string]bool
+}
+
+// useNaming - Sets the naming of request-scoped channels, unless a CacheChannels further out already did
+func (col *channelCollector) useNaming(naming ChannelNaming) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	if col.naming == nil {
+		col.naming = &naming
+	}
+}
+
+// name - Returns the channels to send for request-scoped channels
+func (col *channelCollector) name(channels []string) []string {
+	col.mu.Lock()
+	naming := ChannelNaming{}
+	if col.naming != nil {
+		naming = *col.naming
+	}
+	col.mu.Unlock()
+
+	named := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		named = append(named, naming.channels(ch)...)
+	}
+
+	return named
+}
+
+// add - Adds channels to the collector, skipping duplicates and empty channels
+func (col *channelCollector) add(channels ...string) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	if col.seen == nil {
+		col.seen = map[string]bool{}
+	}
+
+	for _, ch := range channels {
+		if ch == "" || col.seen[ch] {
+			continue
+		}
+
+		col.seen[ch] = true
+		col.channels = append(col.channels, ch)
+	}
+}
+
+// list - Returns a copy of the collected channels
+func (col *channelCollector) list() []string {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	return append([]string(nil), col.channels...)
+}
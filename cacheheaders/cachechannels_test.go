@@ -1,16 +1,22 @@
 package cacheheaders
 
 import (
-	"github.com/gorilla/mux"
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/gorilla/mux"
 )
 
 func TestCacheChannels(t *testing.T) {
 	// Test 1: Strip non-alphanumeric characters
 	cc := &CacheChannels{
 		Varnish: true,
+		Naming:  ChannelNaming{NonASCII: DropNonASCII},
 	}
 	cc.Set("Cat(øøøøø)_Articles//")
 
@@ -66,3 +72,91 @@ func testCChan(cc *CacheChannels, expected cacheChanExpected, t *testing.T) {
 		t.Errorf("Cache Tag header mismatch!\nExpected: %v\nGot     : %v\n", expected.Tag, gotTag)
 	}
 }
+
+func TestAddChannels(t *testing.T) {
+	cc := &CacheChannels{Varnish: true, Cloudflare: true}
+	cc.Set("static")
+
+	router := mux.NewRouter()
+	router.Use(cc.SendHeaders)
+	router.HandleFunc("/article/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// add channels concurrently, the way a handler fetching data in parallel might
+		var wg sync.WaitGroup
+		for _, ch := range []string{"article-" + mux.Vars(r)["id"], "section-sport", "static"} {
+			wg.Add(1)
+			go func(ch string) {
+				defer wg.Done()
+				if !AddChannels(r.Context(), ch) {
+					t.Errorf("AddChannels didn't find a collector in the request context")
+				}
+			}(ch)
+		}
+		wg.Wait()
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/article/123", nil)
+	router.ServeHTTP(recorder, request)
+
+	got := strings.Split(recorder.Header().Get(CacheChannelHeader), ", ")
+	sort.Strings(got)
+	expected := []string{"article-123", "section-sport", "static"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Cache Channel header mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+
+	// the static channels must not be affected by request-scoped channels
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/article/456", nil)
+	router.ServeHTTP(recorder, request)
+
+	if got := recorder.Header().Get(CacheChannelHeader); strings.Contains(got, "article-123") {
+		t.Errorf("Request-scoped channel leaked into another request: %v", got)
+	}
+
+	// without the middleware, AddChannels is a no-op
+	if AddChannels(context.Background(), "orphan") {
+		t.Errorf("AddChannels should return false without a collector in the context")
+	}
+}
+
+func TestCacheChannelsConcurrentSet(t *testing.T) {
+	cc := &CacheChannels{Varnish: true}
+	cc.Set("static")
+
+	handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// reconfigure the channels while requests are being served (run with -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cc.Set("static")
+				cc.Add("frontpage")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+				got := recorder.Header().Get(CacheChannelHeader)
+				if got != "static" && got != "static, frontpage" {
+					t.Errorf("Unexpected Cache Channel header during updates: %q", got)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := cc.Channels(); strings.Join(got, ",") != "static,frontpage" {
+		t.Errorf("Channels mismatch!\nExpected: %v\nGot     : %v\n", "static,frontpage", got)
+	}
+}
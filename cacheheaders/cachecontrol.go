@@ -1,78 +1,629 @@
 package cacheheaders
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Surrogate-Control: Used by Varnish and Fastly style surrogates, which remove it before passing the response on
+const SurrogateControlHeader = "Surrogate-Control"
+
+// CDN-Cache-Control: Used by any CDN that implements RFC 9213 targeted cache control
+const CDNCacheControlHeader = "CDN-Cache-Control"
+
+// Cloudflare-CDN-Cache-Control: Used by Cloudflare only, and not passed on to downstream caches
+const CloudflareCDNCacheControlHeader = "Cloudflare-CDN-Cache-Control"
+
 // CacheControl - A middleware struct that outputs cache control directives for browsers and cache proxies
-// Currently limited to the core set of directives necessary to achieve configurable caching and TTL.
-// NB: This implementation assumes that the CacheControl configuration will not change during runtime.
+// Covers the response directives of RFC 9111, plus the immutable (RFC 8246) and stale-* (RFC 5861) extensions.
+// Build it with NewCacheControl, or call Validate once the configuration is complete, to catch contradictory combinations of directives.
+// The setters and Update are safe to call while the CacheControl is serving requests: the header values are rendered once,
+// then reused until the next change. Exported fields may only be set directly before the CacheControl is in use.
+// To swap whole sets of cache policies at runtime, see PolicyTable.
 type CacheControl struct {
-	Private              bool    // "private"  - tells Varnish and Cloudflare to never cache this response (browsers will though)
-	NoStore              bool    // "no-store" - tells proxy caches and browsers that this response contains sensitive data and should not be cached or stored anywhere after use
-	maxAge               *int    // see SetMaxAge
-	sMaxAge              *int    // see SetSMaxAge
-	staleWhileRevalidate *int    // see SetStaleWhileRevalidate
-	cached               *string // contains the cache-control string after first generation
+	Public          bool // "public" - allows proxy caches to store the response, even if they normally wouldn't (eg. when the request had an Authorization header)
+	Private         bool // "private"  - tells Varnish and Cloudflare to never cache this response (browsers will though)
+	NoStore         bool // "no-store" - tells proxy caches and browsers that this response contains sensitive data and should not be cached or stored anywhere after use
+	MustRevalidate  bool // "must-revalidate" - once stale, the response must not be used without successful revalidation
+	ProxyRevalidate bool // "proxy-revalidate" - same as must-revalidate, but only for proxy caches
+	NoTransform     bool // "no-transform" - proxies must not transform the payload (eg. recompress images)
+	Immutable       bool // "immutable" - the response won't change while fresh, so browsers can skip revalidation on reload
+	MustUnderstand  bool // "must-understand" - caches should only store the response if they understand the caching rules of its status code. Requires NoStore, which older caches fall back to.
+
+	// Targeted cache control: each tier of proxies gets its own set of directives, in its own header.
+	// Proxies that obey a targeted header ignore Cache-Control, which is left to browsers and any other caches.
+	SurrogateControl          *CacheControl // directives for the "Surrogate-Control" header (Varnish, Fastly)
+	CDNCacheControl           *CacheControl // directives for the "CDN-Cache-Control" header (RFC 9213, any CDN)
+	CloudflareCDNCacheControl *CacheControl // directives for the "Cloudflare-CDN-Cache-Control" header (Cloudflare only)
+
+	// Safety - optional. Downgrades the directives of personalised responses, eg. for requests with an Authorization header.
+	// Defaults to DefaultSafetyRules. Set it to &SafetyRules{} to always send the configured directives.
+	Safety *SafetyRules
+
+	Expires bool  // if true, also sends an "Expires" header computed from max-age, for HTTP/1.0 caches (and a date in the past for responses they must not reuse)
+	Age     bool  // if true, sends an "Age" header for responses that already have a Date or Age header, eg. when proxying an upstream server (RFC 9111 section 4.2.3)
+	Clock   Clock // optional. The clock used for Expires and Age. Defaults to the system clock.
+
+	Metrics Metrics // optional. Counts responses by the class of their Cache-Control header and status code.
+
+	// OnInvalid - optional. Called when a configuration with contradictory directives is about to be sent as "no-store" instead
+	// (see Validate), once per change of the configuration, eg. to log it or fail a health check. Defaults to logging it.
+	OnInvalid func(err error)
+
+	maxAge               *int        // see SetMaxAge
+	sMaxAge              *int        // see SetSMaxAge
+	staleWhileRevalidate *int        // see SetStaleWhileRevalidate
+	staleIfError         *int        // see SetStaleIfError
+	noCache              bool        // see SetNoCache
+	noCacheFields        []string    // see SetNoCache
+	privateFields        []string    // qualified "private", see ParseCacheControl
+	extensions           []Extension // see AddExtension
+	vary                 Vary        // see AddVary
+
+	mu       sync.RWMutex // guards the configuration against concurrent changes, see Update
+	updateMu sync.Mutex   // serializes calls to Update
+	rendered atomic.Value // *renderedHeaders, or a nil one after every change
+}
+
+// renderedHeaders - The header values produced by a CacheControl configuration, rendered once and reused until the next change
+type renderedHeaders struct {
+	cacheControl string       // the Cache-Control header value
+	private      string       // the Cache-Control header value with any proxy-cacheable directives replaced by "private", for Vary: * and downgraded responses
+	noStore      bool         // whether the configuration already keeps responses out of every cache
+	vary         *Vary        // a copy of the configured Vary field names
+	targeted     []targetedCC // the targeted cache control configurations that are set
+	safety       *SafetyRules // the configured safety rules, or the default ones
+	maxAge       int          // the max-age value, or -1 if not set
+	uncacheable  bool         // whether HTTP/1.0 caches must not reuse the response at all (private, no-store or unqualified no-cache)
+	expires      bool         // see CacheControl.Expires
+	age          bool         // see CacheControl.Age
+	clock        Clock        // the configured clock, or the system clock
+	metrics      Metrics      // see CacheControl.Metrics
+}
+
+// targetedCC - A targeted cache control configuration, and the header it's sent in
+type targetedCC struct {
+	header string
+	cc     *CacheControl
+}
+
+// Extension - A cache directive that CacheControl doesn't know about, eg. "max-stale" or a CDN specific directive.
+type Extension struct {
+	Name     string // lowercase directive name
+	Value    string // directive argument, unquoted
+	HasValue bool   // whether the directive has an argument at all, to tell `foo` and `foo=""` apart
+}
+
+// String - Returns the directive as it appears in a header, quoting the argument if needed
+func (e Extension) String() string {
+	if !e.HasValue {
+		return e.Name
+	}
+
+	if isToken(e.Value) {
+		return e.Name + "=" + e.Value
+	}
+
+	return e.Name + "=" + quoteString(e.Value)
 }
 
 // SetMaxAge - Sets the "max-age" header:
 // The TTL (in seconds) that browsers should obey. Varnish will use this if s-maxage is not set.
 func (cc *CacheControl) SetMaxAge(value int) {
-	cc.maxAge = &value
+	cc.Update(func(cc *CacheControl) { cc.maxAge = &value })
 }
 
 // SetSMaxAge - Sets the "s-maxage" header:
 // The TTL (in seconds) that Varnish, Cloudflare and other proxy-caches should obey
 func (cc *CacheControl) SetSMaxAge(value int) {
-	cc.sMaxAge = &value
+	cc.Update(func(cc *CacheControl) { cc.sMaxAge = &value })
 }
 
 // SetStaleWhileRevalidate - Sets the "stale-while-revalidate" header:
 // The number of seconds during which browsers will reuse a stale response while sending a revalidation request in the background
 func (cc *CacheControl) SetStaleWhileRevalidate(value int) {
-	cc.staleWhileRevalidate = &value
+	cc.Update(func(cc *CacheControl) { cc.staleWhileRevalidate = &value })
+}
+
+// SetStaleIfError - Sets the "stale-if-error" header:
+// The number of seconds during which caches may serve a stale response if revalidation fails with an error (eg. a 5xx)
+func (cc *CacheControl) SetStaleIfError(value int) {
+	cc.Update(func(cc *CacheControl) { cc.staleIfError = &value })
+}
+
+// SetNoCache - Sets the "no-cache" header:
+// Caches may store the response, but must revalidate it before every reuse.
+// If header field names are specified, only those fields must not be reused without revalidation,
+// eg. `SetNoCache("Set-Cookie")` results in `no-cache="Set-Cookie"`.
+func (cc *CacheControl) SetNoCache(fieldNames ...string) {
+	cc.Update(func(cc *CacheControl) {
+		cc.noCache = true
+		cc.noCacheFields = fieldNames
+	})
+}
+
+// AddExtension - Adds a directive that CacheControl doesn't cover with its own fields and setters.
+// Extensions are sent after the regular directives, in the order they were added.
+func (cc *CacheControl) AddExtension(ext Extension) {
+	cc.Update(func(cc *CacheControl) { cc.extensions = append(cc.extensions, ext) })
+}
+
+// AddVary - Adds request headers that the response varies on, eg. "Accept-Encoding" or a device-class header.
+// When the response starts, they're merged with any field names set by the handler or other layers (see the AddVary function),
+// normalized, and sent as a single Vary header.
+func (cc *CacheControl) AddVary(fields ...string) {
+	cc.Update(func(cc *CacheControl) { cc.vary.Add(fields...) })
+}
+
+// Update - Changes the configuration, eg. `cc.Update(func(cc *CacheControl) { cc.Public = true })`.
+// Safe to call while the CacheControl is serving requests: fn gets a copy of the configuration,
+// which replaces the current one once fn returns. Requests in flight see either the old or the new configuration, never a mix.
+// NB: fn must only change the copy it's given, not the CacheControl that Update was called on.
+func (cc *CacheControl) Update(fn func(cc *CacheControl)) {
+	cc.updateMu.Lock()
+	defer cc.updateMu.Unlock()
+
+	cc.mu.RLock()
+	updated := cc.clone()
+	cc.mu.RUnlock()
+
+	fn(updated)
+
+	cc.mu.Lock()
+	copyConfig(cc, updated)
+	cc.rendered.Store((*renderedHeaders)(nil))
+	cc.mu.Unlock()
+}
+
+// Vary - Returns a copy of the configured Vary field names
+func (cc *CacheControl) Vary() *Vary {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	vary := &Vary{}
+	vary.Merge(&cc.vary)
+
+	return vary
+}
+
+// MaxAge - Returns the "max-age" value, and whether it is set
+func (cc *CacheControl) MaxAge() (int, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return intValue(cc.maxAge)
+}
+
+// SMaxAge - Returns the "s-maxage" value, and whether it is set
+func (cc *CacheControl) SMaxAge() (int, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return intValue(cc.sMaxAge)
+}
+
+// StaleWhileRevalidate - Returns the "stale-while-revalidate" value, and whether it is set
+func (cc *CacheControl) StaleWhileRevalidate() (int, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return intValue(cc.staleWhileRevalidate)
+}
+
+// StaleIfError - Returns the "stale-if-error" value, and whether it is set
+func (cc *CacheControl) StaleIfError() (int, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return intValue(cc.staleIfError)
+}
+
+// NoCache - Returns the "no-cache" field names (if any), and whether no-cache is set
+func (cc *CacheControl) NoCache() ([]string, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return cc.noCacheFields, cc.noCache
+}
+
+// PrivateFields - Returns the field names of a qualified "private" directive, eg. `private="Set-Cookie"`.
+// Unlike the Private field, a qualified private only keeps the listed fields out of proxy caches.
+func (cc *CacheControl) PrivateFields() []string {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return cc.privateFields
+}
+
+// Extensions - Returns the directives that CacheControl doesn't cover with its own fields and setters
+func (cc *CacheControl) Extensions() []Extension {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return cc.extensions
+}
+
+// String - Returns the Cache-Control header value produced by the configuration
+func (cc *CacheControl) String() string {
+	return cc.cacheControlString()
+}
+
+// NewCacheControl - Returns a CacheControl configured by fn, or an error if the configuration is invalid (see Validate), eg.
+// `cacheheaders.NewCacheControl(func(cc *cacheheaders.CacheControl) { cc.Public = true; cc.SetMaxAge(60) })`
+func NewCacheControl(fn func(cc *CacheControl)) (*CacheControl, error) {
+	cc := &CacheControl{}
+	fn(cc)
+
+	if err := cc.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cc, nil
+}
+
+// Validate - Returns an error if the configuration contains contradictory or malformed directives,
+// eg. "public" together with "private", or "no-store" together with a max-age.
+// Meant to be called once during setup, so that a broken configuration fails early.
+// Contradictory directives are never sent though: caches would each resolve them their own way, so a configuration
+// whose header would contain any (eg. "public, private") is sent as "no-store" instead, without any targeted headers,
+// and reported through OnInvalid.
+// Directives that the header leaves out anyway, like an s-maxage with private, don't trigger this.
+func (cc *CacheControl) Validate() error {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	if cc.Public && cc.Private {
+		return errors.New("cache-control: public and private are mutually exclusive")
+	}
+
+	for _, d := range []struct {
+		name  string
+		value *int
+	}{
+		{"max-age", cc.maxAge},
+		{"s-maxage", cc.sMaxAge},
+		{"stale-while-revalidate", cc.staleWhileRevalidate},
+		{"stale-if-error", cc.staleIfError},
+	} {
+		if d.value == nil {
+			continue
+		}
+
+		if *d.value < 0 {
+			return fmt.Errorf("cache-control: %s can't be negative (got %d)", d.name, *d.value)
+		}
+
+		if cc.NoStore {
+			return fmt.Errorf("cache-control: no-store can't be combined with %s", d.name)
+		}
+	}
+
+	if cc.NoStore && (cc.Public || cc.Immutable || cc.noCache) {
+		return errors.New("cache-control: no-store can't be combined with public, immutable or no-cache")
+	}
+
+	if cc.MustUnderstand && !cc.NoStore {
+		return errors.New("cache-control: must-understand requires no-store")
+	}
+
+	if cc.Private && (cc.sMaxAge != nil || cc.ProxyRevalidate) {
+		return errors.New("cache-control: private can't be combined with proxy directives (s-maxage, proxy-revalidate)")
+	}
+
+	if cc.vary.Wildcard() && cc.proxyCacheable() {
+		return errors.New("cache-control: Vary: * responses can't be reused by caches, so they must be private or no-store")
+	}
+
+	for _, field := range cc.noCacheFields {
+		if !isToken(field) {
+			return fmt.Errorf("cache-control: invalid no-cache field name %q", field)
+		}
+	}
+
+	for _, field := range cc.privateFields {
+		if !isToken(field) {
+			return fmt.Errorf("cache-control: invalid private field name %q", field)
+		}
+	}
+
+	for _, ext := range cc.extensions {
+		if !isToken(ext.Name) {
+			return fmt.Errorf("cache-control: invalid extension directive name %q", ext.Name)
+		}
+	}
+
+	for _, t := range []struct {
+		header string
+		cc     *CacheControl
+	}{
+		{SurrogateControlHeader, cc.SurrogateControl},
+		{CDNCacheControlHeader, cc.CDNCacheControl},
+		{CloudflareCDNCacheControlHeader, cc.CloudflareCDNCacheControl},
+	} {
+		if t.cc == nil {
+			continue
+		}
+
+		if err := t.cc.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", t.header, err)
+		}
+	}
+
+	return nil
 }
 
 // SendHeaders - A middleware function compatible with most routers.
 // Outputs cache headers according to the CacheControl configuration.
+// The header is written when the response starts, ie. on the first WriteHeader / Write,
+// and a Cache-Control header set by the handler itself takes precedence over the configuration.
 func (cc *CacheControl) SendHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ccs := cc.cacheControlString()
-		if ccs != "" {
-			w.Header().Set("Cache-Control", ccs)
-		}
+		requested := cc.requestTime()
+		hw := &headerWriter{ResponseWriter: w, before: func(h http.Header, status int) {
+			cc.writeHeaders(r, h, status, requested)
+		}}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(hw, r)
+		hw.finalize(http.StatusOK) // the handler might not have written anything
 	})
 }
 
+// requestTime - Returns the current time if it's needed to compute the Age header, or else the zero time
+func (cc *CacheControl) requestTime() time.Time {
+	if rh := cc.render(); rh.age {
+		return rh.clock.Now()
+	}
+
+	return time.Time{}
+}
+
+// writeHeaders - Writes the Vary header, the Cache-Control header and any targeted cache control headers,
+// except for the ones the handler has already set. Personalised responses are downgraded according to the safety rules.
+// requested is the time the request arrived (see requestTime), or the zero time if unknown.
+func (cc *CacheControl) writeHeaders(r *http.Request, h http.Header, status int, requested time.Time) {
+	rh := cc.render()
+	handlerDirectives := h.Get("Cache-Control") != ""
+
+	vary := ParseVary(h.Values("Vary")...)
+	vary.Merge(rh.vary)
+	setVary(h, vary)
+
+	directives, targeted := rh.cacheControl, rh.targeted
+	if handlerDirectives {
+		// CDNs obey targeted headers over Cache-Control, so the configured ones would override what the handler decided
+		targeted = nil
+	}
+
+	if vary.Wildcard() {
+		// caches can't reuse the response, so proxy-cacheable directives would only be misleading
+		directives, targeted = rh.private, nil
+	}
+
+	var downgrade []DowngradeReason
+	if d := rh.safety.check(r, h); d.Action != DowngradeNone && !handlerDirectives && !rh.noStore {
+		downgraded := rh.private
+		if d.Action == DowngradeNoStore {
+			downgraded = "no-store"
+		}
+
+		// only report downgrades that change anything
+		if downgraded != directives || len(targeted) > 0 {
+			directives, targeted, downgrade = downgraded, nil, d.Reasons
+			if rh.safety.OnDowngrade != nil {
+				rh.safety.OnDowngrade(r, d)
+			}
+		}
+	}
+
+	setDirectives(h, "Cache-Control", directives)
+	for _, t := range targeted {
+		setDirectives(h, t.header, t.cc.cacheControlString())
+	}
+
+	if info := debugInfoFrom(r.Context()); info != nil {
+		info.recordDirectives(cc, h.Get("Cache-Control"), downgrade)
+	}
+
+	if rh.metrics != nil {
+		rh.metrics.CountResponse(ClassifyDirectives(h.Get("Cache-Control")), statusClass(status))
+	}
+
+	if !rh.expires && !rh.age {
+		return
+	}
+
+	now := rh.clock.Now()
+	age := time.Duration(0)
+	if rh.age && (h.Get("Date") != "" || h.Get("Age") != "") {
+		if requested.IsZero() {
+			requested = now
+		}
+
+		age = CurrentAge(h, requested, now, now)
+		SetAge(h, age)
+	}
+
+	if rh.expires && !handlerDirectives && h.Get("Expires") == "" {
+		switch {
+		case rh.uncacheable || directives != rh.cacheControl: // private, no-store or downgraded
+			h.Set("Expires", expiredDate)
+		case rh.maxAge >= 0:
+			h.Set("Expires", now.Add(time.Duration(rh.maxAge)*time.Second-age).UTC().Format(http.TimeFormat))
+		}
+	}
+}
+
+// setDirectives - Sets a header to a cache control string, unless it's empty or the header is already set
+func setDirectives(h http.Header, name string, directives string) {
+	if directives == "" || h.Get(name) != "" {
+		return
+	}
+
+	h.Set(name, directives)
+}
+
 func (cc *CacheControl) cacheControlString() string {
-	if cc.cached != nil {
-		return *cc.cached // string has already been generated once
+	return cc.render().cacheControl
+}
+
+// render - Returns the header values of the current configuration, rendering them if it changed since the last call.
+// Lock-free (and allocation-free) once rendered, as it's called for every response.
+func (cc *CacheControl) render() *renderedHeaders {
+	if rh, _ := cc.rendered.Load().(*renderedHeaders); rh != nil {
+		return rh // already rendered since the last change
+	}
+
+	// reported once the lock is released, so that OnInvalid can use the CacheControl
+	var invalid error
+	var onInvalid func(err error)
+	defer func() {
+		if invalid == nil {
+			return
+		}
+
+		if onInvalid == nil {
+			log.Printf("cacheheaders: sending no-store instead of contradictory directives: %s", invalid)
+			return
+		}
+		onInvalid(invalid)
+	}()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if rh, _ := cc.rendered.Load().(*renderedHeaders); rh != nil {
+		return rh // rendered by a concurrent call while waiting for the lock
+	}
+
+	onInvalid = cc.OnInvalid
+
+	rh := &renderedHeaders{cacheControl: strings.Join(cc.makeSlice(), ", "), noStore: cc.NoStore, vary: &Vary{}, safety: cc.Safety}
+	rh.vary.Merge(&cc.vary)
+
+	if rh.safety == nil {
+		rh.safety = &DefaultSafetyRules
+	}
+
+	rh.maxAge = -1
+	if cc.maxAge != nil {
+		rh.maxAge = *cc.maxAge
+	}
+
+	rh.uncacheable = cc.Private || cc.NoStore || cc.noCache && len(cc.noCacheFields) == 0
+	rh.expires, rh.age, rh.clock, rh.metrics = cc.Expires, cc.Age, cc.Clock, cc.Metrics
+	if rh.clock == nil {
+		rh.clock = systemClock
+	}
+
+	// every directive but no-store lets shared caches store the response in some way (eg. no-cache or must-revalidate),
+	// so the downgraded directives always include an unqualified private
+	rh.private = rh.cacheControl
+	if !cc.NoStore {
+		private := cc.clone()
+		private.Public, private.ProxyRevalidate, private.Private = false, false, true
+		private.sMaxAge, private.privateFields = nil, nil
+		rh.private = strings.Join(private.makeSlice(), ", ")
+	}
+
+	for _, t := range []targetedCC{
+		{SurrogateControlHeader, cc.SurrogateControl},
+		{CDNCacheControlHeader, cc.CDNCacheControl},
+		{CloudflareCDNCacheControlHeader, cc.CloudflareCDNCacheControl},
+	} {
+		if t.cc != nil {
+			rh.targeted = append(rh.targeted, t)
+		}
 	}
 
-	// make a slice of cache control directives
-	ccSlice := cc.makeSlice()
+	// contradictory directives are never sent, see Validate
+	parsed, err := ParseCacheControl(rh.cacheControl)
+	if err == nil {
+		err = parsed.Validate()
+	}
+
+	if err != nil {
+		invalid = fmt.Errorf("%q: %w", rh.cacheControl, err)
+		rh.cacheControl, rh.private, rh.targeted = "no-store", "no-store", nil
+		rh.noStore, rh.uncacheable, rh.maxAge = true, true, -1
+	}
+
+	cc.rendered.Store(rh)
+	return rh
+}
+
+// clone - Returns a copy of the configuration. The caller must hold cc.mu.
+func (cc *CacheControl) clone() *CacheControl {
+	c := &CacheControl{}
+	copyConfig(c, cc)
+
+	return c
+}
+
+// copyConfig - Copies the configuration of src into dst, so that they share no mutable state.
+// The caller must hold src.mu, and dst.mu unless dst isn't shared yet.
+func copyConfig(dst, src *CacheControl) {
+	dst.Public, dst.Private, dst.NoStore = src.Public, src.Private, src.NoStore
+	dst.MustRevalidate, dst.ProxyRevalidate = src.MustRevalidate, src.ProxyRevalidate
+	dst.NoTransform, dst.Immutable, dst.MustUnderstand = src.NoTransform, src.Immutable, src.MustUnderstand
+	dst.SurrogateControl, dst.CDNCacheControl, dst.CloudflareCDNCacheControl = src.SurrogateControl, src.CDNCacheControl, src.CloudflareCDNCacheControl
+	dst.Safety = src.Safety
+	dst.Expires, dst.Age, dst.Clock, dst.Metrics, dst.OnInvalid = src.Expires, src.Age, src.Clock, src.Metrics, src.OnInvalid
 
-	// join directives into a string, then cache it
-	joined := strings.Join(ccSlice, ", ")
-	cc.cached = &joined
+	// the int pointers are never written through, so they can be shared
+	dst.maxAge, dst.sMaxAge = src.maxAge, src.sMaxAge
+	dst.staleWhileRevalidate, dst.staleIfError = src.staleWhileRevalidate, src.staleIfError
 
-	return joined
+	dst.noCache = src.noCache
+	dst.noCacheFields = append([]string(nil), src.noCacheFields...)
+	dst.privateFields = append([]string(nil), src.privateFields...)
+	dst.extensions = append([]Extension(nil), src.extensions...)
+
+	dst.vary = Vary{}
+	dst.vary.Merge(&src.vary)
+}
+
+// proxyCacheable - Checks whether the directives allow proxy caches to store the response
+func (cc *CacheControl) proxyCacheable() bool {
+	if cc.NoStore || cc.Private {
+		return false
+	}
+
+	return cc.Public || cc.maxAge != nil || cc.sMaxAge != nil || cc.ProxyRevalidate
 }
 
 // makeSlice - constructs a slice of cache-control headers based on CacheControl config
 func (cc *CacheControl) makeSlice() []string {
 
 	if cc.NoStore {
-		return []string{"no-store"}
+		cacheControl := []string{"no-store"}
+		if cc.MustUnderstand {
+			cacheControl = []string{"must-understand", "no-store"}
+		}
+
+		return cc.appendExtensions(cacheControl)
 	}
 
 	cacheControl := []string{}
 
+	if cc.Public {
+		cacheControl = append(cacheControl, "public")
+	}
+
+	if cc.noCache {
+		if len(cc.noCacheFields) > 0 {
+			cacheControl = append(cacheControl, `no-cache="`+strings.Join(cc.noCacheFields, ", ")+`"`)
+		} else {
+			cacheControl = append(cacheControl, "no-cache")
+		}
+	}
+
 	if cc.maxAge != nil {
 		cacheControl = append(cacheControl, "max-age="+strconv.Itoa(*cc.maxAge))
 	}
@@ -81,14 +632,71 @@ func (cc *CacheControl) makeSlice() []string {
 		cacheControl = append(cacheControl, "stale-while-revalidate="+strconv.Itoa(*cc.staleWhileRevalidate))
 	}
 
+	if cc.staleIfError != nil {
+		cacheControl = append(cacheControl, "stale-if-error="+strconv.Itoa(*cc.staleIfError))
+	}
+
+	if cc.MustRevalidate {
+		cacheControl = append(cacheControl, "must-revalidate")
+	}
+
+	if cc.NoTransform {
+		cacheControl = append(cacheControl, "no-transform")
+	}
+
+	if cc.Immutable {
+		cacheControl = append(cacheControl, "immutable")
+	}
+
 	if cc.Private {
 		cacheControl = append(cacheControl, "private")
-		return cacheControl // proxy caching disallowed: No need to send proxy-specific headers
+		return cc.appendExtensions(cacheControl) // proxy caching disallowed: No need to send proxy-specific headers
+	}
+
+	if len(cc.privateFields) > 0 {
+		cacheControl = append(cacheControl, `private="`+strings.Join(cc.privateFields, ", ")+`"`)
 	}
 
 	if cc.sMaxAge != nil {
 		cacheControl = append(cacheControl, "s-maxage="+strconv.Itoa(*cc.sMaxAge))
 	}
 
+	if cc.ProxyRevalidate {
+		cacheControl = append(cacheControl, "proxy-revalidate")
+	}
+
+	return cc.appendExtensions(cacheControl)
+}
+
+// appendExtensions - appends the extension directives to a slice of cache-control directives
+func (cc *CacheControl) appendExtensions(cacheControl []string) []string {
+	for _, ext := range cc.extensions {
+		cacheControl = append(cacheControl, ext.String())
+	}
+
 	return cacheControl
 }
+
+// intValue - dereferences an optional int directive
+func intValue(value *int) (int, bool) {
+	if value == nil {
+		return 0, false
+	}
+
+	return *value, true
+}
+
+// isToken - Checks whether s is a valid RFC 9110 token, eg. a header field name
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c > 127 || !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -3,6 +3,8 @@ package cacheheaders
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -63,3 +65,236 @@ func testCC(cc *CacheControl, expected string, t *testing.T) {
 		t.Errorf("Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
 	}
 }
+
+func TestCacheControlDirectives(t *testing.T) {
+	// case 1: every public-cache directive at once
+	cc := &CacheControl{Public: true, MustRevalidate: true, ProxyRevalidate: true, NoTransform: true, Immutable: true}
+	cc.SetMaxAge(20)
+	cc.SetSMaxAge(40)
+	cc.SetStaleWhileRevalidate(120)
+	cc.SetStaleIfError(600)
+	expected := "public, max-age=20, stale-while-revalidate=120, stale-if-error=600, must-revalidate, no-transform, immutable, s-maxage=40, proxy-revalidate"
+	testCC(cc, expected, t)
+
+	// case 2: no-cache with a field list
+	cc = &CacheControl{}
+	cc.SetNoCache("Set-Cookie", "X-Session")
+	cc.SetMaxAge(60)
+	expected = `no-cache="Set-Cookie, X-Session", max-age=60`
+	testCC(cc, expected, t)
+
+	// case 3: unqualified no-cache
+	cc = &CacheControl{}
+	cc.SetNoCache()
+	testCC(cc, "no-cache", t)
+
+	// case 4: must-understand, with no-store as the fallback for caches that don't understand it
+	cc = &CacheControl{NoStore: true, MustUnderstand: true}
+	testCC(cc, "must-understand, no-store", t)
+}
+
+func TestCacheControlValidate(t *testing.T) {
+	valid := &CacheControl{Public: true, Immutable: true}
+	valid.SetMaxAge(31536000)
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %s", err.Error())
+	}
+
+	withMaxAge := func(cc *CacheControl) *CacheControl {
+		cc.SetMaxAge(30)
+		return cc
+	}
+	withSMaxAge := func(cc *CacheControl) *CacheControl {
+		cc.SetSMaxAge(30)
+		return cc
+	}
+	withNoCache := func(cc *CacheControl, fields ...string) *CacheControl {
+		cc.SetNoCache(fields...)
+		return cc
+	}
+	negative := &CacheControl{}
+	negative.SetStaleIfError(-1)
+
+	invalid := map[string]*CacheControl{
+		"public + private":           {Public: true, Private: true},
+		"no-store + max-age":         withMaxAge(&CacheControl{NoStore: true}),
+		"no-store + s-maxage":        withSMaxAge(&CacheControl{NoStore: true}),
+		"no-store + no-cache":        withNoCache(&CacheControl{NoStore: true}),
+		"no-store + immutable":       {NoStore: true, Immutable: true},
+		"must-understand alone":      {MustUnderstand: true},
+		"private + s-maxage":         withSMaxAge(&CacheControl{Private: true}),
+		"private + proxy-revalidate": {Private: true, ProxyRevalidate: true},
+		"negative stale-if-error":    negative,
+		"malformed no-cache field":   withNoCache(&CacheControl{}, "Set Cookie"),
+	}
+
+	for name, cc := range invalid {
+		if err := cc.Validate(); err == nil {
+			t.Errorf("Expected a validation error for %s (%s)", name, cc.cacheControlString())
+		}
+	}
+
+	// contradictory directives are sent as no-store, the ones the header leaves out don't matter
+	cdn := &CacheControl{}
+	cdn.SetMaxAge(600)
+	sent := map[string]*CacheControl{
+		"public + private":         {Public: true, Private: true, CDNCacheControl: cdn},
+		"must-understand alone":    {MustUnderstand: true},
+		"negative stale-if-error":  negative,
+		"malformed no-cache field": withNoCache(&CacheControl{}, "Set Cookie"),
+		"no-store + max-age":       withMaxAge(&CacheControl{NoStore: true}),
+		"private + s-maxage":       withSMaxAge(&CacheControl{Private: true}),
+	}
+	expected := map[string]string{
+		"public + private":         "no-store",
+		"must-understand alone":    "", // left out of the header without no-store
+		"negative stale-if-error":  "no-store",
+		"malformed no-cache field": "no-store",
+		"no-store + max-age":       "no-store",
+		"private + s-maxage":       "private",
+	}
+
+	for name, cc := range sent {
+		// reported once per change of the configuration, not for every response
+		var reported []error
+		cc.OnInvalid = func(err error) { reported = append(reported, err) }
+
+		for i := 0; i < 2; i++ {
+			recorder := httptest.NewRecorder()
+			cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+			h := recorder.Header()
+			if got := h.Get("Cache-Control"); got != expected[name] || h.Get(CDNCacheControlHeader) != "" {
+				t.Errorf("%s: Cache Control header mismatch!\nExpected: %v\nGot     : %v (CDN-Cache-Control: %q)\n", name, expected[name], got, h.Get(CDNCacheControlHeader))
+			}
+		}
+
+		// no-store + max-age is sent as a plain no-store, which isn't a contradiction
+		contradictory := expected[name] == "no-store" && name != "no-store + max-age"
+		if contradictory && len(reported) != 1 || !contradictory && len(reported) != 0 {
+			t.Errorf("%s: Unexpected reported errors: %v", name, reported)
+		}
+	}
+
+	// built with NewCacheControl, a contradictory configuration is an error right away
+	if _, err := NewCacheControl(func(cc *CacheControl) { cc.Public, cc.Private = true, true }); err == nil {
+		t.Errorf("Expected a validation error from NewCacheControl")
+	}
+
+	cc, err := NewCacheControl(func(cc *CacheControl) {
+		cc.Public = true
+		cc.SetMaxAge(60)
+	})
+	if err != nil || cc.String() != "public, max-age=60" {
+		t.Errorf("Unexpected result from NewCacheControl: %v, %v", cc, err)
+	}
+}
+
+func TestTargetedCacheControl(t *testing.T) {
+	surrogate := &CacheControl{}
+	surrogate.SetMaxAge(3600)
+	surrogate.SetStaleWhileRevalidate(60)
+
+	cdn := &CacheControl{}
+	cdn.SetMaxAge(600)
+
+	cloudflare := &CacheControl{NoStore: true}
+
+	cc := &CacheControl{SurrogateControl: surrogate, CDNCacheControl: cdn, CloudflareCDNCacheControl: cloudflare}
+	cc.SetMaxAge(30)
+
+	if err := cc.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %s", err.Error())
+	}
+
+	handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	expected := map[string]string{
+		"Cache-Control":                 "max-age=30", // the browser-facing header is unaffected by the targeted ones
+		SurrogateControlHeader:          "max-age=3600, stale-while-revalidate=60",
+		CDNCacheControlHeader:           "max-age=600",
+		CloudflareCDNCacheControlHeader: "no-store",
+	}
+
+	for header, value := range expected {
+		if got := recorder.Header().Get(header); got != value {
+			t.Errorf("%s header mismatch!\nExpected: %v\nGot     : %v\n", header, value, got)
+		}
+	}
+
+	// targeted configurations are validated along with the main one
+	cdn.Public, cdn.Private = true, true
+	if err := cc.Validate(); err == nil {
+		t.Errorf("Expected a validation error for an invalid %s configuration", CDNCacheControlHeader)
+	}
+}
+
+func TestCacheControlUpdate(t *testing.T) {
+	cc := &CacheControl{}
+	cc.SetMaxAge(30)
+
+	handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	get := func() string {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		return recorder.Header().Get("Cache-Control")
+	}
+
+	if got := get(); got != "max-age=30" {
+		t.Errorf("Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", "max-age=30", got)
+	}
+
+	// setters and Update take effect after the header has been rendered
+	cc.SetMaxAge(60)
+	cc.Update(func(cc *CacheControl) {
+		cc.Public = true
+		cc.SetSMaxAge(600)
+	})
+
+	expected := "public, max-age=60, s-maxage=600"
+	if got := get(); got != expected {
+		t.Errorf("Cache Control header mismatch after an update!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+
+	// concurrent updates and requests (run with -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cc.SetMaxAge(i*100 + j)
+				cc.AddVary("Accept-Encoding")
+				cc.Update(func(cc *CacheControl) { cc.Immutable = j%2 == 0 })
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := get(); !strings.HasPrefix(got, "public, max-age=") {
+					t.Errorf("Unexpected Cache-Control header during updates: %q", got)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCacheControlStringAllocs(t *testing.T) {
+	cc := &CacheControl{Public: true}
+	cc.SetMaxAge(60)
+	cc.SetStaleWhileRevalidate(30)
+	_ = cc.String() // rendered once
+
+	if allocs := testing.AllocsPerRun(100, func() { _ = cc.cacheControlString() }); allocs != 0 {
+		t.Errorf("Expected no allocations once rendered, got %v", allocs)
+	}
+}
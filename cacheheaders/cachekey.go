@@ -0,0 +1,127 @@
+package cacheheaders
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrVaryWildcard - Returned by CacheKey for responses with "Vary: *", which caches can't reuse
+var ErrVaryWildcard = errors.New("cacheheaders: responses with Vary: * can't have a cache key")
+
+// DefaultTrackingParams - Query parameters that only matter to analytics, and are stripped from cache keys by default
+var DefaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "_ga", "_gl"}
+
+// CacheKeyOptions - Options for CacheKey
+type CacheKeyOptions struct {
+	// Vary - optional. The request headers the cached response varies on, eg. `ParseVary(res.Header.Values("Vary")...)`.
+	Vary *Vary
+
+	// StripParams - Query parameters to leave out of the key. A trailing * matches any suffix, eg. "utm_*".
+	// Defaults to DefaultTrackingParams if nil. Set it to an empty slice to keep every parameter.
+	StripParams []string
+
+	// Hasher - optional. Hashes the key, eg. a *fasthash.Hasher (github.com/dbmedialab/pkg/fasthash).
+	// Without it, the key is returned as is, which is handy for debugging but can get long.
+	Hasher Hasher
+}
+
+// CacheKey - Returns a canonical cache key for the request, for caches that store responses by request.
+// Requests that only differ in ways that don't change the response get the same key:
+// the scheme and host are lowercased (and default ports dropped), query parameters are sorted and tracking parameters stripped.
+// The values of the request headers listed in opts.Vary are folded in, so each variant of a response gets its own key.
+func CacheKey(r *http.Request, opts CacheKeyOptions) (string, error) {
+	if opts.Vary != nil && opts.Vary.Wildcard() {
+		return "", ErrVaryWildcard
+	}
+
+	scheme := strings.ToLower(r.URL.Scheme)
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	host = strings.ToLower(host)
+
+	switch scheme {
+	case "http":
+		host = strings.TrimSuffix(host, ":80")
+	case "https":
+		host = strings.TrimSuffix(host, ":443")
+	}
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(scheme + "://" + host + path)
+
+	if query := canonicalQuery(r.URL.RawQuery, opts.StripParams); query != "" {
+		sb.WriteString("?" + query)
+	}
+
+	if opts.Vary != nil {
+		fields := append([]string(nil), opts.Vary.Fields()...)
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			// a copy: Values returns the request's own slice
+			values := append([]string(nil), r.Header.Values(field)...)
+			for i := range values {
+				values[i] = strings.TrimSpace(values[i])
+			}
+
+			// quoted, so that header values can't be mistaken for other fields
+			sb.WriteString(" " + field + "=" + strconv.Quote(strings.Join(values, ", ")))
+		}
+	}
+
+	key := sb.String()
+	if opts.Hasher == nil {
+		return key, nil
+	}
+
+	return opts.Hasher.MakeBase64CheckSum([]byte(key))
+}
+
+// canonicalQuery - Sorts the query parameters by name (keeping the order of repeated ones) and strips the unwanted ones
+func canonicalQuery(rawQuery string, strip []string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	if strip == nil {
+		strip = DefaultTrackingParams
+	}
+
+	values, _ := url.ParseQuery(rawQuery) // malformed pairs are skipped, the way servers skip them too
+	for name := range values {
+		if matchName(strip, name) {
+			delete(values, name)
+		}
+	}
+
+	return values.Encode()
+}
+
+// matchName - Checks whether a name matches one of the patterns, where a trailing * matches any suffix
+func matchName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == name || strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
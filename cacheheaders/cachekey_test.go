@@ -0,0 +1,90 @@
+package cacheheaders
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// reverseHasher - A Hasher that makes its input easy to recognise in the output
+type reverseHasher struct{}
+
+func (reverseHasher) MakeBase64CheckSum(b []byte) (string, error) {
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func TestCacheKey(t *testing.T) {
+	vary := ParseVary("accept-language, Accept-Encoding")
+
+	tests := []struct {
+		url      string
+		header   map[string]string
+		opts     CacheKeyOptions
+		expected string
+	}{
+		{"http://Example.COM:80/article/1", nil, CacheKeyOptions{}, "http://example.com/article/1"},
+		{"http://example.com", nil, CacheKeyOptions{}, "http://example.com/"},
+		{"http://example.com:8080/a%2Fb", nil, CacheKeyOptions{}, "http://example.com:8080/a%2Fb"},
+		{"http://example.com/?b=2&a=1&a=0", nil, CacheKeyOptions{}, "http://example.com/?a=1&a=0&b=2"},
+		{"http://example.com/?utm_source=x&utm_medium=y&fbclid=z&id=1", nil, CacheKeyOptions{}, "http://example.com/?id=1"},
+		{"http://example.com/?utm_source=x&ref=y", nil, CacheKeyOptions{StripParams: []string{"ref"}}, "http://example.com/?utm_source=x"},
+		{"http://example.com/?utm_source=x", nil, CacheKeyOptions{StripParams: []string{}}, "http://example.com/?utm_source=x"},
+		{
+			"http://example.com/",
+			map[string]string{"Accept-Language": "nb", "Accept-Encoding": " gzip ", "Cookie": "ignored"},
+			CacheKeyOptions{Vary: vary},
+			`http://example.com/ Accept-Encoding="gzip" Accept-Language="nb"`,
+		},
+		{"http://example.com/", nil, CacheKeyOptions{Vary: vary}, `http://example.com/ Accept-Encoding="" Accept-Language=""`},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		for name, value := range tt.header {
+			r.Header.Set(name, value)
+		}
+
+		got, err := CacheKey(r, tt.opts)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", tt.url, err.Error())
+		}
+
+		if got != tt.expected {
+			t.Errorf("Cache key mismatch for %s!\nExpected: %v\nGot     : %v\n", tt.url, tt.expected, got)
+		}
+	}
+}
+
+func TestCacheKeyOptions(t *testing.T) {
+	// TLS requests without an absolute URL, as received by a server
+	r := httptest.NewRequest("GET", "/article/1", nil)
+	r.Host = "Example.com:443"
+	r.TLS = &tls.ConnectionState{}
+
+	expected := "https://example.com/article/1"
+	got, err := CacheKey(r, CacheKeyOptions{Hasher: reverseHasher{}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if got != base64.StdEncoding.EncodeToString([]byte(expected)) {
+		t.Errorf("Hashed cache key mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+
+	// the varying header values are trimmed in the key, but not in the request
+	r.Header["Accept-Language"] = []string{" nb ", "en"}
+	if _, err := CacheKey(r, CacheKeyOptions{Vary: ParseVary("Accept-Language")}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if got := r.Header["Accept-Language"]; got[0] != " nb " {
+		t.Errorf("Request header mismatch!\nExpected: %v\nGot     : %v\n", []string{" nb ", "en"}, got)
+	}
+
+	// Vary: * responses can't be cached at all
+	if _, err := CacheKey(r, CacheKeyOptions{Vary: ParseVary("*")}); !errors.Is(err, ErrVaryWildcard) {
+		t.Errorf("Expected ErrVaryWildcard, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package cacheprom - A Prometheus implementation of cacheheaders.Metrics
+//
+//	metrics := cacheprom.New("myservice")
+//	prometheus.MustRegister(metrics)
+//
+//	ctrl := &cacheheaders.CacheControl{Metrics: metrics}
+//	channels := &cacheheaders.CacheChannels{Varnish: true, Metrics: metrics}
+package cacheprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dbmedialab/pkg/cacheheaders"
+)
+
+// ChannelBuckets - The histogram buckets for the number of channels per response
+var ChannelBuckets = []float64{0, 1, 2, 5, 10, 20, 50, 100, 200}
+
+// Metrics - Implements cacheheaders.Metrics with a counter and a histogram, and prometheus.Collector to expose them:
+// <namespace>_cacheheaders_responses_total{class, status} and <namespace>_cacheheaders_channels{status}
+type Metrics struct {
+	responses *prometheus.CounterVec
+	channels  *prometheus.HistogramVec
+}
+
+// make sure Metrics implements both interfaces
+var _ cacheheaders.Metrics = (*Metrics)(nil)
+var _ prometheus.Collector = (*Metrics)(nil)
+
+// New - Returns the metrics, with names prefixed by the namespace (if any). Register them with a prometheus.Registerer.
+func New(namespace string) *Metrics {
+	return &Metrics{
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cacheheaders",
+			Name:      "responses_total",
+			Help:      "Responses by the class of their Cache-Control directives (no-store, private, no-cache, cacheable, none) and status code.",
+		}, []string{"class", "status"}),
+
+		channels: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "cacheheaders",
+			Name:      "channels",
+			Help:      "The number of cache channels per response, before CDN limits are applied.",
+			Buckets:   ChannelBuckets,
+		}, []string{"status"}),
+	}
+}
+
+// CountResponse - Implements cacheheaders.Metrics
+func (m *Metrics) CountResponse(class cacheheaders.DirectiveClass, statusClass string) {
+	m.responses.WithLabelValues(string(class), statusClass).Inc()
+}
+
+// ObserveChannels - Implements cacheheaders.Metrics
+func (m *Metrics) ObserveChannels(count int, statusClass string) {
+	m.channels.WithLabelValues(statusClass).Observe(float64(count))
+}
+
+// Describe - Implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.responses.Describe(ch)
+	m.channels.Describe(ch)
+}
+
+// Collect - Implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.responses.Collect(ch)
+	m.channels.Collect(ch)
+}
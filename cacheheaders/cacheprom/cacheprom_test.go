@@ -0,0 +1,58 @@
+package cacheprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/dbmedialab/pkg/cacheheaders"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := New("test")
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metrics); err != nil {
+		t.Fatalf("Unexpected registration error: %s", err.Error())
+	}
+
+	cc := &cacheheaders.CacheControl{NoStore: true, Metrics: metrics}
+	channels := &cacheheaders.CacheChannels{Varnish: true, Metrics: metrics}
+	channels.Set("frontpage", "article-1")
+
+	handler := cc.SendHeaders(channels.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	if got := testutil.ToFloat64(metrics.responses.WithLabelValues("no-store", "2xx")); got != 3 {
+		t.Errorf("Response count mismatch!\nExpected: %v\nGot     : %v\n", 3, got)
+	}
+
+	expected := `
+# HELP test_cacheheaders_channels The number of cache channels per response, before CDN limits are applied.
+# TYPE test_cacheheaders_channels histogram
+test_cacheheaders_channels_bucket{status="2xx",le="0"} 0
+test_cacheheaders_channels_bucket{status="2xx",le="1"} 0
+test_cacheheaders_channels_bucket{status="2xx",le="2"} 3
+test_cacheheaders_channels_bucket{status="2xx",le="5"} 3
+test_cacheheaders_channels_bucket{status="2xx",le="10"} 3
+test_cacheheaders_channels_bucket{status="2xx",le="20"} 3
+test_cacheheaders_channels_bucket{status="2xx",le="50"} 3
+test_cacheheaders_channels_bucket{status="2xx",le="100"} 3
+test_cacheheaders_channels_bucket{status="2xx",le="200"} 3
+test_cacheheaders_channels_bucket{status="2xx",le="+Inf"} 3
+test_cacheheaders_channels_sum{status="2xx"} 6
+test_cacheheaders_channels_count{status="2xx"} 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "test_cacheheaders_channels"); err != nil {
+		t.Errorf("Channel histogram mismatch: %s", err.Error())
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/dbmedialab/pkg/cacheheaders/cacheprom
+
+go 1.16
+
+require (
+	github.com/dbmedialab/pkg/cacheheaders v0.0.0-20261018015601-7fbcc499d951
+	github.com/prometheus/client_golang v1.12.2
+)
+
+// builds inside this repository use the cacheheaders next to it. Other modules ignore this, and get the version required above.
+replace github.com/dbmedialab/pkg/cacheheaders => ../
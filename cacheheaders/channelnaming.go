@@ -0,0 +1,137 @@
+package cacheheaders
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"unicode/utf8"
+)
+
+// NonASCII - What ChannelNaming does with non-ASCII characters, eg. "ø" or "ü"
+type NonASCII int
+
+const (
+	TransliterateNonASCII NonASCII = iota // replaced by their closest ASCII spelling: "Tromsø" becomes "Tromso". Segments with characters that can't be transliterated are hashed. The default.
+	HashNonASCII                          // segments with non-ASCII characters get a hash of their original spelling appended: "Tromsø" becomes "Troms-" + 8 hex characters
+	DropNonASCII                          // removed like any other illegal character: "Cat(øøø)" becomes "Cat", so "Vår" and "Var" are the same channel
+)
+
+// ChannelNaming - How the channels given to CacheChannels are turned into the channels it sends.
+// The zero value transliterates non-ASCII characters (see TransliterateNonASCII), and removes the other characters
+// outside the legal range: a-z, A-Z, 0-9, _, -
+// A Purger (or ResponseCache) must use the same naming as the CacheChannels whose channels it purges.
+type ChannelNaming struct {
+	// Namespace - optional. Prefixed to every channel, eg. "frontend" turns "article-123" into "frontend-article-123",
+	// so that services sharing a cache proxy can't collide with, or purge, each other's channels.
+	Namespace string
+
+	// Hierarchical - if true, "/" separates the levels of a channel, and every level is sent:
+	// "section/sport/football" becomes "section", "section-sport" and "section-sport-football",
+	// so that a purge can target any level. Purging "section/sport" purges "section-sport" only.
+	Hierarchical bool
+
+	NonASCII NonASCII // optional. Defaults to TransliterateNonASCII.
+}
+
+// channels - Returns the channels to send for a channel, ie. every level of a hierarchical channel, prefixed with the namespace
+func (n ChannelNaming) channels(ch string) []string {
+	levels := []string{ch}
+	if n.Hierarchical {
+		levels = strings.Split(ch, "/")
+	}
+
+	prefix := n.segment(n.Namespace)
+	channels := make([]string, 0, len(levels))
+	for _, level := range levels {
+		level = n.segment(level)
+		if level == "" {
+			continue
+		}
+
+		if prefix != "" {
+			prefix += "-"
+		}
+		prefix += level
+		channels = append(channels, prefix)
+	}
+
+	return channels
+}
+
+// key - Returns the channel that identifies a channel when purging, ie. its deepest level. Empty if nothing legal is left of it.
+func (n ChannelNaming) key(ch string) string {
+	channels := n.channels(ch)
+	if len(channels) == 0 {
+		return ""
+	}
+
+	return channels[len(channels)-1]
+}
+
+// segment - Prunes a single level of a channel, handling non-ASCII characters according to the NonASCII setting
+func (n ChannelNaming) segment(s string) string {
+	if n.NonASCII == DropNonASCII || !hasNonASCII(s) {
+		return pruneChannel(s)
+	}
+
+	if n.NonASCII == TransliterateNonASCII {
+		if transliterated, ok := transliterate(s); ok {
+			return pruneChannel(transliterated)
+		}
+	}
+
+	// the hash keeps channels that only differ by their non-ASCII characters apart, eg. "Vår" and "Var"
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if pruned := pruneChannel(s); pruned != "" {
+		return pruned + "-" + sum
+	}
+
+	return sum
+}
+
+// hasNonASCII - Reports whether the string contains any non-ASCII characters
+func hasNonASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transliterate - Replaces the non-ASCII characters of the string by their ASCII spelling.
+// Returns false if any of them can't be transliterated.
+func transliterate(s string) (string, bool) {
+	var b strings.Builder
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+			continue
+		}
+
+		ascii, ok := transliterations[r]
+		if !ok {
+			return "", false
+		}
+		b.WriteString(ascii)
+	}
+
+	return b.String(), true
+}
+
+// transliterations - The ASCII spelling of the Latin letters used by the Nordic and Western European languages
+var transliterations = map[rune]string{
+	'æ': "ae", 'Æ': "AE", 'ø': "o", 'Ø': "O", 'å': "a", 'Å': "A",
+	'ä': "a", 'Ä': "A", 'ö': "o", 'Ö': "O", 'ü': "u", 'Ü': "U", 'ß': "ss",
+	'á': "a", 'à': "a", 'â': "a", 'ã': "a", 'Á': "A", 'À': "A", 'Â': "A", 'Ã': "A",
+	'é': "e", 'è': "e", 'ê': "e", 'ë': "e", 'É': "E", 'È': "E", 'Ê': "E", 'Ë': "E",
+	'í': "i", 'ì': "i", 'î': "i", 'ï': "i", 'Í': "I", 'Ì': "I", 'Î': "I", 'Ï': "I",
+	'ó': "o", 'ò': "o", 'ô': "o", 'õ': "o", 'Ó': "O", 'Ò': "O", 'Ô': "O", 'Õ': "O",
+	'ú': "u", 'ù': "u", 'û': "u", 'Ú': "U", 'Ù': "U", 'Û': "U",
+	'ý': "y", 'ÿ': "y", 'Ý': "Y", 'ñ': "n", 'Ñ': "N", 'ç': "c", 'Ç': "C",
+	'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "TH",
+}
@@ -0,0 +1,76 @@
+package cacheheaders
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChannelNaming(t *testing.T) {
+	tests := []struct {
+		naming   ChannelNaming
+		channel  string
+		expected string
+	}{
+		{ChannelNaming{}, "Cat(øøøøø)_Articles//", "Catooooo_Articles"},
+		{ChannelNaming{}, "Москва", "feb471b1"}, // transliterated by default, with the hash as the fallback
+		{ChannelNaming{NonASCII: DropNonASCII}, "Cat(øøøøø)_Articles//", "Cat_Articles"},
+		{ChannelNaming{}, "section/sport/football", "sectionsportfootball"},
+		{ChannelNaming{Namespace: "front end"}, "article-123", "frontend-article-123"},
+		{ChannelNaming{Hierarchical: true}, "section/sport/football", "section, section-sport, section-sport-football"},
+		{ChannelNaming{Hierarchical: true, Namespace: "frontend"}, "/section//sport/", "frontend-section, frontend-section-sport"},
+		{ChannelNaming{Hierarchical: true, NonASCII: DropNonASCII}, "(øø)/sport", "sport"},
+		{ChannelNaming{NonASCII: TransliterateNonASCII}, "Tromsø_Ærø-Straße", "Tromso_AEro-Strasse"},
+		{ChannelNaming{NonASCII: TransliterateNonASCII}, "Москва", "feb471b1"}, // can't be transliterated, so it's hashed
+		{ChannelNaming{NonASCII: HashNonASCII}, "Vår", "Vr-9a8f5869"},
+		{ChannelNaming{NonASCII: HashNonASCII}, "Var", "Var"},
+		{ChannelNaming{Hierarchical: true, NonASCII: TransliterateNonASCII}, "sted/Tromsø", "sted, sted-Tromso"},
+	}
+
+	for _, tt := range tests {
+		if got := strings.Join(tt.naming.channels(tt.channel), ", "); got != tt.expected {
+			t.Errorf("Channels mismatch for %q (%+v)!\nExpected: %v\nGot     : %v\n", tt.channel, tt.naming, tt.expected, got)
+		}
+	}
+}
+
+func TestChannelNamingHeaders(t *testing.T) {
+	naming := ChannelNaming{Namespace: "frontend", Hierarchical: true}
+	cc := &CacheChannels{Varnish: true, Naming: naming}
+	cc.Set("frontpage")
+
+	// an inner CacheChannels, with its own static channels, doesn't change the naming of request-scoped channels
+	inner := &CacheChannels{}
+	inner.Set("inner")
+
+	handler := cc.SendHeaders(inner.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddChannels(r.Context(), "section/sport", "article/123")
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	expected := "frontend-frontpage, inner, frontend-section, frontend-section-sport, frontend-article, frontend-article-123"
+	if got := recorder.Header().Get(CacheChannelHeader); got != expected {
+		t.Errorf("Cache Channel header mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+
+	// purging a level targets that level only, with the namespace
+	var banned string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		banned = r.Header.Get(CacheChannelHeader)
+	}))
+	defer server.Close()
+
+	vp := &VarnishPurger{Endpoints: []string{server.URL}, PurgeOptions: PurgeOptions{Naming: naming}}
+	if err := vp.Purge(context.Background(), "section/sport"); err != nil {
+		t.Fatalf("Unexpected purge error: %s", err.Error())
+	}
+
+	if expected := banRegex([]string{"frontend-section-sport"}); banned != expected {
+		t.Errorf("Ban regex mismatch!\nExpected: %v\nGot     : %v\n", expected, banned)
+	}
+}
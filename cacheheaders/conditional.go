@@ -0,0 +1,305 @@
+package cacheheaders
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Hasher - Produces a checksum of a response body, for use as a strong ETag.
+// A *fasthash.Hasher (github.com/dbmedialab/pkg/fasthash) satisfies this interface.
+type Hasher interface {
+	MakeBase64CheckSum(b []byte) (string, error)
+}
+
+// Conditional - A middleware struct that handles conditional requests (RFC 9110 section 13).
+//
+// For GET and HEAD requests, it buffers successful responses and gives them a strong ETag computed from the body,
+// unless the handler has set an ETag of its own. It then answers If-None-Match / If-Modified-Since with a 304,
+// and If-Match / If-Unmodified-Since with a 412, using the handler's Last-Modified header (if any) for the date-based ones.
+// Responses that aren't a 200, that are flushed by the handler, or whose body grows larger than MaxBufferSize, are passed through untouched.
+//
+// For unsafe methods (POST, PUT, PATCH, DELETE...), preconditions must be evaluated before the handler changes anything,
+// so the current validators of the resource are looked up through Validators. Without it, unsafe requests are passed through.
+//
+// 304 responses carry the same Cache-Control, channel and Vary headers as the full response would have,
+// as long as those middlewares and the handler set them before the response is written.
+type Conditional struct {
+	Hasher        Hasher // optional. Computes the ETag of a response body. Defaults to a truncated SHA-256.
+	MaxBufferSize int    // optional. Responses with a larger body are passed through, without an ETag. Defaults to 1 MB.
+
+	// Validators - optional. Returns the current ETag (quoted, eg. `"abc"`) and Last-Modified time of the resource targeted by an unsafe request.
+	// Return an empty ETag and a zero time if the resource doesn't exist.
+	Validators func(r *http.Request) (etag string, lastModified time.Time)
+}
+
+// Handler - A middleware function compatible with most routers. Answers conditional requests, see Conditional.
+func (c *Conditional) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if c.Validators != nil && hasPreconditions(r) {
+				etag, lastModified := c.Validators(r)
+				if status := evaluatePreconditions(r, etag, lastModified); status != 0 {
+					w.WriteHeader(http.StatusPreconditionFailed) // unsafe methods never get a 304
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bw := &bufferWriter{ResponseWriter: w, limit: c.maxBufferSize()}
+		next.ServeHTTP(bw, r)
+
+		if bw.passthrough {
+			return // the response has already been sent
+		}
+
+		h := w.Header()
+		if h.Get("ETag") == "" {
+			etag, err := c.etag(bw.buf.Bytes())
+			if err == nil {
+				h.Set("ETag", etag)
+			}
+		}
+
+		lastModified, _ := http.ParseTime(h.Get("Last-Modified"))
+		switch evaluatePreconditions(r, h.Get("ETag"), lastModified) {
+		case http.StatusNotModified:
+			for _, name := range []string{"Content-Length", "Content-Type", "Transfer-Encoding"} {
+				h.Del(name)
+			}
+			w.WriteHeader(http.StatusNotModified)
+
+		case http.StatusPreconditionFailed:
+			h.Del("Content-Length")
+			w.WriteHeader(http.StatusPreconditionFailed)
+
+		default:
+			bw.start()
+		}
+	})
+}
+
+// etag - Computes a strong ETag from the response body
+func (c *Conditional) etag(body []byte) (string, error) {
+	if c.Hasher != nil {
+		sum, err := c.Hasher.MakeBase64CheckSum(body)
+		if err != nil {
+			return "", err
+		}
+
+		return `"` + sum + `"`, nil
+	}
+
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// maxBufferSize - Returns the configured buffer size limit, or the default
+func (c *Conditional) maxBufferSize() int {
+	if c.MaxBufferSize > 0 {
+		return c.MaxBufferSize
+	}
+
+	return 1 << 20
+}
+
+// hasPreconditions - Checks whether the request has any of the precondition headers
+func hasPreconditions(r *http.Request) bool {
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// evaluatePreconditions - Evaluates the request's preconditions against the current validators,
+// in the order given by RFC 9110 section 13.2.2.
+// Returns 304 or 412 if the request should be answered with that status, or 0 if it should proceed.
+func evaluatePreconditions(r *http.Request, etag string, lastModified time.Time) int {
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	// 1. If-Match, or else 2. If-Unmodified-Since
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !matchETag(im, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && !lastModified.IsZero() {
+		if lastModified.Truncate(time.Second).After(ius) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	// 3. If-None-Match, or else 4. If-Modified-Since (for GET and HEAD only)
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if matchETag(inm, etag, false) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && safe && !lastModified.IsZero() {
+		if !lastModified.Truncate(time.Second).After(ims) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// matchETag - Checks whether an If-Match / If-None-Match header value matches the current ETag.
+// If-Match uses the strong comparison (both tags must be strong and identical), If-None-Match the weak one (W/ is ignored).
+func matchETag(header, etag string, strong bool) bool {
+	if etag == "" {
+		return false // the resource has no current representation
+	}
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	current, currentWeak := splitETag(etag)
+	for _, candidate := range strings.Split(header, ",") {
+		opaque, weak := splitETag(strings.TrimSpace(candidate))
+		if opaque != current {
+			continue
+		}
+
+		if !strong || !weak && !currentWeak {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitETag - Splits an entity tag into its opaque tag (quotes included) and its weakness indicator
+func splitETag(etag string) (opaque string, weak bool) {
+	if strings.HasPrefix(etag, "W/") {
+		return etag[2:], true
+	}
+
+	return etag, false
+}
+
+// bufferWriter - A http.ResponseWriter wrapper that holds back a 200 response, so that it can be replaced by a 304 / 412.
+// Any other status, a flush by the handler, or a body larger than the limit switches it to passing everything straight through.
+type bufferWriter struct {
+	http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	limit       int
+	passthrough bool
+}
+
+// WriteHeader - Records the status code. Anything but a 200 is sent right away, informational responses (eg. 103 Early Hints) included.
+func (bw *bufferWriter) WriteHeader(status int) {
+	if informational(status) {
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if bw.passthrough || bw.status != 0 {
+		if bw.passthrough {
+			bw.ResponseWriter.WriteHeader(status)
+		}
+		return
+	}
+
+	bw.status = status
+	if status != http.StatusOK {
+		bw.start()
+	}
+}
+
+// Write - Buffers the body of a 200 response, until it grows larger than the limit
+func (bw *bufferWriter) Write(b []byte) (int, error) {
+	if !bw.passthrough && bw.buf.Len()+len(b) > bw.limit {
+		bw.start()
+	}
+
+	if bw.passthrough {
+		return bw.ResponseWriter.Write(b)
+	}
+
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+
+	return bw.buf.Write(b)
+}
+
+// ReadFrom - Buffers the body of a 200 response like Write, and copies the rest of a larger one
+// with the underlying io.ReaderFrom (eg. sendfile) if there is one
+func (bw *bufferWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if !bw.passthrough {
+		// one byte past the limit tells a body that fits from one that doesn't
+		copied, err := io.Copy(writerOnly{bw}, io.LimitReader(r, int64(bw.limit-bw.buf.Len()+1)))
+		if n = copied; err != nil || !bw.passthrough {
+			return n, err
+		}
+	}
+
+	var rest int64
+	var err error
+	if rf, ok := bw.ResponseWriter.(io.ReaderFrom); ok {
+		rest, err = rf.ReadFrom(r)
+	} else {
+		rest, err = io.Copy(writerOnly{bw.ResponseWriter}, r)
+	}
+
+	return n + rest, err
+}
+
+// Flush - Gives up on buffering, since the handler is streaming its response
+func (bw *bufferWriter) Flush() {
+	bw.start()
+	if f, ok := bw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack - Lets the handler take over the connection, see headerWriter.Hijack
+func (bw *bufferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := bw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	bw.passthrough = true
+	return h.Hijack()
+}
+
+// Unwrap - Returns the underlying ResponseWriter, for use by http.ResponseController
+func (bw *bufferWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// start - Sends the recorded status and the buffered body, and passes everything through from then on
+func (bw *bufferWriter) start() {
+	if bw.passthrough {
+		return
+	}
+
+	bw.passthrough = true
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+
+	bw.ResponseWriter.WriteHeader(bw.status)
+	if bw.buf.Len() > 0 {
+		_, _ = bw.ResponseWriter.Write(bw.buf.Bytes())
+		bw.buf.Reset()
+	}
+}
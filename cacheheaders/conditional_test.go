@@ -0,0 +1,208 @@
+package cacheheaders
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubHasher - A Hasher with a predictable output
+type stubHasher struct{}
+
+func (stubHasher) MakeBase64CheckSum(b []byte) (string, error) {
+	return "len" + strings.Repeat("x", len(b)), nil
+}
+
+func TestConditionalGet(t *testing.T) {
+	lastModified := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cc := &CacheControl{}
+	cc.SetMaxAge(60)
+	cond := &Conditional{Hasher: stubHasher{}}
+
+	handler := cc.SendHeaders(cond.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tagged":
+			w.Header().Set("ETag", `W/"v1"`)
+		case "/dated":
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("body"))
+	})))
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		etag    string
+	}{
+		{"computed etag", "/", nil, http.StatusOK, `"lenxxxx"`},
+		{"if-none-match hit", "/", map[string]string{"If-None-Match": `"other", "lenxxxx"`}, http.StatusNotModified, `"lenxxxx"`},
+		{"if-none-match weak hit", "/", map[string]string{"If-None-Match": `W/"lenxxxx"`}, http.StatusNotModified, `"lenxxxx"`},
+		{"if-none-match miss", "/", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, `"lenxxxx"`},
+		{"if-none-match star", "/", map[string]string{"If-None-Match": `*`}, http.StatusNotModified, `"lenxxxx"`},
+		{"handler etag", "/tagged", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified, `W/"v1"`},
+		{"if-match strong miss on weak etag", "/tagged", map[string]string{"If-Match": `W/"v1"`}, http.StatusPreconditionFailed, `W/"v1"`},
+		{"if-match strong hit", "/", map[string]string{"If-Match": `"lenxxxx"`}, http.StatusOK, `"lenxxxx"`},
+		{"if-modified-since not modified", "/dated", map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, http.StatusNotModified, `"lenxxxx"`},
+		{"if-modified-since modified", "/dated", map[string]string{"If-Modified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, `"lenxxxx"`},
+		{"if-none-match takes precedence over if-modified-since", "/dated", map[string]string{
+			"If-None-Match":     `"other"`,
+			"If-Modified-Since": lastModified.Format(http.TimeFormat),
+		}, http.StatusOK, `"lenxxxx"`},
+		{"if-unmodified-since failed", "/dated", map[string]string{"If-Unmodified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusPreconditionFailed, `"lenxxxx"`},
+		{"errors pass through", "/missing", map[string]string{"If-None-Match": `*`}, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		request := httptest.NewRequest("GET", tt.path, nil)
+		for name, value := range tt.headers {
+			request.Header.Set(name, value)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != tt.status {
+			t.Errorf("%s: status mismatch!\nExpected: %v\nGot     : %v\n", tt.name, tt.status, recorder.Code)
+		}
+
+		if got := recorder.Header().Get("ETag"); got != tt.etag {
+			t.Errorf("%s: ETag mismatch!\nExpected: %v\nGot     : %v\n", tt.name, tt.etag, got)
+		}
+
+		switch recorder.Code {
+		case http.StatusOK:
+			if recorder.Body.String() != "body" {
+				t.Errorf("%s: body mismatch: %q", tt.name, recorder.Body.String())
+			}
+		case http.StatusNotModified:
+			if recorder.Body.Len() != 0 || recorder.Header().Get("Content-Type") != "" {
+				t.Errorf("%s: a 304 must not have a body or Content-Type", tt.name)
+			}
+
+			if got := recorder.Header().Get("Cache-Control"); got != "max-age=60" {
+				t.Errorf("%s: a 304 must carry the cache headers, got Cache-Control: %q", tt.name, got)
+			}
+		}
+	}
+}
+
+func TestConditionalMaxBufferSize(t *testing.T) {
+	cond := &Conditional{Hasher: stubHasher{}, MaxBufferSize: 8}
+
+	var readFrom bool
+	handler := cond.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.NewReader(strings.TrimPrefix(r.URL.Path, "/"))
+		if r.URL.Query().Get("readfrom") != "" {
+			_, readFrom = w.(io.ReaderFrom)
+			_, _ = w.(io.ReaderFrom).ReadFrom(body)
+			return
+		}
+
+		_, _ = io.Copy(writerOnly{w}, body)
+	}))
+
+	tests := []struct {
+		target string
+		etag   string
+		status int
+	}{
+		{"/small", `"lenxxxxx"`, http.StatusNotModified},
+		{"/small?readfrom=1", `"lenxxxxx"`, http.StatusNotModified},
+		{"/larger-than-the-limit", "", http.StatusOK},
+		{"/larger-than-the-limit?readfrom=1", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		r.Header.Set("If-None-Match", "*")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+
+		if got := recorder.Header().Get("ETag"); got != tt.etag {
+			t.Errorf("%s: ETag mismatch!\nExpected: %v\nGot     : %v\n", tt.target, tt.etag, got)
+		}
+		if recorder.Code != tt.status {
+			t.Errorf("%s: Status mismatch!\nExpected: %v\nGot     : %v\n", tt.target, tt.status, recorder.Code)
+		}
+
+		// larger bodies are passed through whole
+		if expected := strings.TrimPrefix(r.URL.Path, "/"); tt.status == http.StatusOK && recorder.Body.String() != expected {
+			t.Errorf("%s: Body mismatch!\nExpected: %v\nGot     : %v\n", tt.target, expected, recorder.Body.String())
+		}
+	}
+
+	if !readFrom {
+		t.Errorf("Expected the ResponseWriter to implement io.ReaderFrom")
+	}
+}
+
+func TestConditionalDefaultHasher(t *testing.T) {
+	cond := &Conditional{}
+	a, _ := cond.etag([]byte("a"))
+	b, _ := cond.etag([]byte("b"))
+
+	if a == b || !strings.HasPrefix(a, `"`) || !strings.HasSuffix(a, `"`) {
+		t.Errorf("Unexpected default ETags: %v, %v", a, b)
+	}
+}
+
+func TestConditionalUnsafe(t *testing.T) {
+	var calls int
+	cond := &Conditional{Validators: func(r *http.Request) (string, time.Time) {
+		if r.URL.Path == "/new" {
+			return "", time.Time{} // doesn't exist yet
+		}
+		return `"v2"`, time.Time{}
+	}}
+
+	handler := cond.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"lost update", "/doc", map[string]string{"If-Match": `"v1"`}, http.StatusPreconditionFailed},
+		{"up to date", "/doc", map[string]string{"If-Match": `"v2"`}, http.StatusNoContent},
+		{"weak tags never match strongly", "/doc", map[string]string{"If-Match": `W/"v2"`}, http.StatusPreconditionFailed},
+		{"create only, exists", "/doc", map[string]string{"If-None-Match": `*`}, http.StatusPreconditionFailed},
+		{"create only, new", "/new", map[string]string{"If-None-Match": `*`}, http.StatusNoContent},
+		{"if-match any, new", "/new", map[string]string{"If-Match": `*`}, http.StatusPreconditionFailed},
+		{"no preconditions", "/doc", nil, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		calls = 0
+		request := httptest.NewRequest("PUT", tt.path, strings.NewReader("data"))
+		for name, value := range tt.headers {
+			request.Header.Set(name, value)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != tt.status {
+			t.Errorf("%s: status mismatch!\nExpected: %v\nGot     : %v\n", tt.name, tt.status, recorder.Code)
+		}
+
+		if tt.status == http.StatusPreconditionFailed && calls != 0 {
+			t.Errorf("%s: the handler must not run when a precondition fails", tt.name)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package cacheheaders
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// X-Cache-Policy-Debug: Used by Debug, to explain the cache headers of a response
+const CachePolicyDebugHeader = "X-Cache-Policy-Debug"
+
+// Debug - A middleware struct that explains the cache headers of a response, for requests that carry a valid debug token.
+// Debug responses get an "X-Cache-Policy-Debug" header with the matched policy, the Cache-Control directives,
+// the reasons they were downgraded (see SafetyRules), and every channel of the response, before any truncation or hashing:
+//
+//	X-Cache-Policy-Debug: policy="article"; cache-control="max-age=60, private"; downgraded="authorization"; channels="articles, article-123"
+//
+// Tokens are signed with the Secret and expire, so that they can be handed out to editors without exposing the mechanism to everyone.
+// Debug responses are never stored by shared caches: their Cache-Control header is replaced with "private, no-store" (the original
+// is kept in the debug header), and the targeted headers are removed, so that the debug header can't leak to other clients.
+// Use it as the outermost middleware (inside a ResponseCache, if any), so that it sees what the other middlewares did.
+type Debug struct {
+	Secret     []byte       // the HMAC key that debug tokens are signed with. Without it, debugging is disabled.
+	Header     string       // optional. The request header that carries the debug token. Defaults to "X-Cache-Debug".
+	QueryParam string       // optional. The query parameter that carries the debug token, removed before the request is passed on. Defaults to "cache-debug".
+	Policies   *PolicyTable // optional. The policy table to list in PoliciesHandler, and match policy names with.
+	Clock      Clock        // optional. Defaults to the system clock.
+
+	mu         sync.Mutex
+	registered []registeredPolicy
+}
+
+// registeredPolicy - A CacheControl configuration built in code, registered under a name
+type registeredPolicy struct {
+	name string
+	cc   *CacheControl
+}
+
+// debugPolicy - A policy as listed by PoliciesHandler
+type debugPolicy struct {
+	Name         string   `json:"name"`
+	Path         string   `json:"path,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	CacheControl string   `json:"cache_control"`
+	Vary         []string `json:"vary,omitempty"`
+	Channels     []string `json:"channels,omitempty"`
+}
+
+// Register - Registers a CacheControl configuration under a name, so that it's named in debug headers and listed by PoliciesHandler.
+// Policies loaded into the Policies table don't need to be registered.
+func (d *Debug) Register(name string, cc *CacheControl) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.registered = append(d.registered, registeredPolicy{name: name, cc: cc})
+}
+
+// Token - Returns a debug token that is valid until the expiry time
+func (d *Debug) Token(expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + d.sign(exp)
+}
+
+// Handler - A middleware function compatible with most routers. Adds the "X-Cache-Policy-Debug" header to debug requests, see Debug.
+func (d *Debug) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ok := d.debugRequest(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info := &debugInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), debugInfoKey{}, info))
+
+		hw := &headerWriter{ResponseWriter: w, before: func(h http.Header, status int) {
+			info.recordHandlerDirectives(strings.Join(h.Values("Cache-Control"), ", "))
+			h.Set(CachePolicyDebugHeader, info.String(d.policyName(info.cc)))
+
+			// the debug header must not be served to anyone else
+			h.Set("Cache-Control", "private, no-store")
+			h.Del(SurrogateControlHeader)
+			h.Del(CDNCacheControlHeader)
+			h.Del(CloudflareCDNCacheControlHeader)
+			h.Del("Expires")
+		}}
+
+		next.ServeHTTP(hw, r)
+		hw.finalize(http.StatusOK) // the handler might not have written anything
+	})
+}
+
+// PoliciesHandler - Returns a handler that lists the registered policies and the ones in the Policies table as JSON.
+// Like the debug header, it requires a valid debug token, and answers 404 without one.
+func (d *Debug) PoliciesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := d.debugRequest(r); !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		policies := []debugPolicy{}
+
+		d.mu.Lock()
+		for _, p := range d.registered {
+			policies = append(policies, debugPolicy{Name: p.name, CacheControl: p.cc.String(), Vary: p.cc.Vary().Fields()})
+		}
+		d.mu.Unlock()
+
+		if d.Policies != nil {
+			for _, p := range d.Policies.Policies() {
+				policies = append(policies, debugPolicy{
+					Name:         p.Name,
+					Path:         p.Path,
+					Methods:      p.Methods,
+					CacheControl: p.cc.String(),
+					Vary:         p.cc.Vary().Fields(),
+					Channels:     p.Channels,
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(map[string][]debugPolicy{"policies": policies})
+	})
+}
+
+// debugRequest - Checks whether the request carries a valid debug token,
+// and returns the request without the token query parameter, so that it doesn't end up in cache keys
+func (d *Debug) debugRequest(r *http.Request) (*http.Request, bool) {
+	header, param := d.Header, d.QueryParam
+	if header == "" {
+		header = "X-Cache-Debug"
+	}
+	if param == "" {
+		param = "cache-debug"
+	}
+
+	token := r.Header.Get(header)
+	if query := r.URL.Query(); query.Get(param) != "" {
+		if token == "" {
+			token = query.Get(param)
+		}
+
+		query.Del(param)
+		u := *r.URL
+		u.RawQuery = query.Encode()
+
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+
+	return r, token != "" && d.verify(token)
+}
+
+// verify - Checks a debug token's signature and expiry
+func (d *Debug) verify(token string) bool {
+	if len(d.Secret) == 0 {
+		return false
+	}
+
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return false
+	}
+
+	exp, sig := token[:dot], token[dot+1:]
+	if !hmac.Equal([]byte(sig), []byte(d.sign(exp))) {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	now := systemClock.Now()
+	if d.Clock != nil {
+		now = d.Clock.Now()
+	}
+
+	return now.Unix() < expires
+}
+
+// sign - Returns the signature of a token's expiry time
+func (d *Debug) sign(exp string) string {
+	mac := hmac.New(sha256.New, d.Secret)
+	mac.Write([]byte("cacheheaders-debug:" + exp))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// policyName - Returns the name a CacheControl configuration was registered under, if any
+func (d *Debug) policyName(cc *CacheControl) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, p := range d.registered {
+		if p.cc == cc {
+			return p.name
+		}
+	}
+
+	return ""
+}
+
+// debugInfoKey - The context key of the debug info of a request
+type debugInfoKey struct{}
+
+// debugInfo - What the middlewares did to a debug request, recorded as they write their headers
+type debugInfo struct {
+	mu         sync.Mutex
+	policy     string            // the name of the matched PolicyTable policy
+	cc         *CacheControl     // the CacheControl configuration that wrote the directives
+	directives string            // the Cache-Control header, as sent
+	downgrade  []DowngradeReason // why the directives were downgraded, if they were
+	channels   []string          // the channels of the response, before any dialect formatting
+	overflows  []Overflow        // the channels that were altered to fit the dialects
+}
+
+// debugInfoFrom - Returns the debug info of a request, or nil if it's not a debug request
+func debugInfoFrom(ctx context.Context) *debugInfo {
+	info, _ := ctx.Value(debugInfoKey{}).(*debugInfo)
+	return info
+}
+
+// recordPolicy - Records the matched PolicyTable policy
+func (info *debugInfo) recordPolicy(name string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	info.policy = name
+}
+
+// recordDirectives - Records the directives written by a CacheControl configuration
+func (info *debugInfo) recordDirectives(cc *CacheControl, directives string, downgrade []DowngradeReason) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	info.cc, info.directives, info.downgrade = cc, directives, downgrade
+}
+
+// recordHandlerDirectives - Records the Cache-Control header as sent, if no CacheControl configuration wrote it
+func (info *debugInfo) recordHandlerDirectives(directives string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	if info.directives == "" {
+		info.directives = directives
+	}
+}
+
+// recordChannels - Records the channels of the response
+func (info *debugInfo) recordChannels(channels []string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	info.channels = channels
+}
+
+// recordOverflows - Records the channels that were altered to fit a dialect
+func (info *debugInfo) recordOverflows(overflows []Overflow) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	info.overflows = append(info.overflows, overflows...)
+}
+
+// String - Returns the debug header value. registered is the name of info.cc, if it was registered.
+func (info *debugInfo) String(registered string) string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	policy := info.policy
+	if policy == "" {
+		policy = registered
+	}
+
+	parts := []string{}
+	add := func(name, value string) {
+		if value != "" {
+			parts = append(parts, name+"="+strconv.Quote(value))
+		}
+	}
+
+	add("policy", policy)
+	add("cache-control", info.directives)
+
+	reasons := make([]string, 0, len(info.downgrade))
+	for _, reason := range info.downgrade {
+		reasons = append(reasons, string(reason))
+	}
+	add("downgraded", strings.Join(reasons, ", "))
+	add("channels", strings.Join(info.channels, ", "))
+
+	for _, o := range info.overflows {
+		add("overflow", o.Header+" "+string(o.Reason)+": "+strings.Join(o.Tags, ", "))
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,143 @@
+package cacheheaders
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebug(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	debug := &Debug{Secret: []byte("secret"), Clock: ClockFunc(func() time.Time { return now })}
+
+	ctrl := &CacheControl{}
+	ctrl.SetMaxAge(60)
+	ctrl.SetSMaxAge(600)
+	debug.Register("default", ctrl)
+
+	channels := &CacheChannels{Dialects: []Dialect{AkamaiDialect}}
+	channels.Set("frontpage")
+
+	var query string
+	handler := debug.Handler(ctrl.SendHeaders(channels.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		AddChannels(r.Context(), "article-123", strings.Repeat("x", 200))
+		w.WriteHeader(http.StatusOK)
+	}))))
+
+	get := func(target string, header http.Header) http.Header {
+		r := httptest.NewRequest("GET", target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+
+		return recorder.Header()
+	}
+
+	token := debug.Token(now.Add(time.Hour))
+
+	// by header, with a downgrade
+	h := get("/article/123", http.Header{"X-Cache-Debug": {token}, "Authorization": {"Bearer token"}})
+	expected := `policy="default"; cache-control="max-age=60, private"; downgraded="authorization"; channels="frontpage, article-123, ` + strings.Repeat("x", 200) + `"; ` +
+		`overflow="Edge-Cache-Tag hashed: ` + strings.Repeat("x", 200) + `"`
+	if got := h.Get(CachePolicyDebugHeader); got != expected {
+		t.Errorf("Debug header mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+
+	// debug responses aren't stored by shared caches
+	if got := h.Get("Cache-Control"); got != "private, no-store" {
+		t.Errorf("Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", "private, no-store", got)
+	}
+
+	// by query parameter, which isn't passed on
+	h = get("/article/123?id=1&cache-debug="+token, nil)
+	if got := h.Get(CachePolicyDebugHeader); !strings.HasPrefix(got, `policy="default"; cache-control="max-age=60, s-maxage=600"; channels=`) {
+		t.Errorf("Unexpected debug header for a query parameter token: %q", got)
+	}
+	if query != "id=1" {
+		t.Errorf("Query mismatch!\nExpected: %v\nGot     : %v\n", "id=1", query)
+	}
+
+	// the targeted headers are removed, and the handler's own Cache-Control header is kept in the debug header
+	cdn := &CacheControl{}
+	cdn.SetSMaxAge(3600)
+	targeted := &CacheControl{CDNCacheControl: cdn, SurrogateControl: cdn}
+	targeted.SetMaxAge(60)
+
+	for name, next := range map[string]http.Handler{
+		"targeted": targeted.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		"handler": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}),
+	} {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Cache-Debug", token)
+		debug.Handler(next).ServeHTTP(recorder, r)
+
+		h := recorder.Header()
+		if got := h.Get("Cache-Control") + "|" + h.Get(CDNCacheControlHeader) + h.Get(SurrogateControlHeader); got != "private, no-store|" {
+			t.Errorf("%s: Headers mismatch!\nExpected: %v\nGot     : %v\n", name, "private, no-store|", got)
+		}
+		if got := h.Get(CachePolicyDebugHeader); !strings.Contains(got, `cache-control="`) || strings.Contains(got, "no-store") {
+			t.Errorf("%s: Expected the original Cache-Control header in the debug header, got %q", name, got)
+		}
+	}
+
+	// invalid tokens are ignored
+	for _, invalid := range []string{
+		"",
+		"garbage",
+		debug.Token(now.Add(-time.Minute)), // expired
+		(&Debug{Secret: []byte("other")}).Token(now.Add(time.Hour)), // wrong secret
+		strings.Replace(token, token[:4], "9999", 1),                // tampered expiry
+	} {
+		if got := get("/", http.Header{"X-Cache-Debug": {invalid}}).Get(CachePolicyDebugHeader); got != "" {
+			t.Errorf("Expected no debug header for token %q, got %q", invalid, got)
+		}
+	}
+}
+
+func TestDebugPoliciesHandler(t *testing.T) {
+	table := &PolicyTable{}
+	if err := table.Load([]byte(testPolicies)); err != nil {
+		t.Fatalf("Unexpected load error: %s", err.Error())
+	}
+
+	debug := &Debug{Secret: []byte("secret"), Policies: table}
+	debug.Register("fallback", &CacheControl{NoStore: true})
+
+	handler := debug.PoliciesHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/cache-policies", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 without a debug token, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/cache-policies?cache-debug="+debug.Token(time.Now().Add(time.Minute)), nil))
+
+	result := struct {
+		Policies []debugPolicy `json:"policies"`
+	}{}
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode the policies: %s", err.Error())
+	}
+
+	if len(result.Policies) != 5 || result.Policies[0].Name != "fallback" || result.Policies[0].CacheControl != "no-store" {
+		t.Fatalf("Unexpected policies: %+v", result.Policies)
+	}
+
+	for _, p := range result.Policies {
+		if p.Name == "article" && (p.Path != "/article/{id}" || p.CacheControl != "max-age=60, s-maxage=600" || p.Vary[0] != "Accept-Encoding") {
+			t.Errorf("Unexpected article policy: %+v", p)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package cacheheaders
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Surrogate-Key: Used by Fastly
+const SurrogateKeyHeader = "Surrogate-Key"
+
+// Edge-Cache-Tag: Used by Akamai
+const EdgeCacheTagHeader = "Edge-Cache-Tag"
+
+// Dialect - Describes how a CDN or cache proxy expects to receive cache channels / cache tags.
+// Implement it to make CacheChannels send tags to a CDN that isn't covered by the built-in dialects.
+type Dialect interface {
+	Header() string                // name of the header that carries the tags
+	Separator() string             // separator between tags in the header value
+	SanitizeTag(tag string) string // applies the per-tag character rules. Tags that end up empty are left out.
+	Limits() TagLimits             // size limits for a single response
+}
+
+// TagLimits - The size limits a CDN imposes on the cache tags of a single response. Zero means unlimited.
+type TagLimits struct {
+	MaxTagLength   int // max length of a single tag, in bytes
+	MaxTags        int // max number of tags
+	MaxHeaderBytes int // max length of the header value, in bytes, separators included
+}
+
+// TagDialect - A Dialect implementation, configured through its fields.
+// The built-in dialects are all TagDialects.
+type TagDialect struct {
+	HeaderName string          // see Dialect.Header
+	Sep        string          // see Dialect.Separator
+	Allowed    func(rune) bool // reports whether a character is allowed in a tag. Other characters are removed. If nil, everything is allowed.
+	TagLimits                  // see Dialect.Limits
+}
+
+// Header - Returns the name of the header that carries the tags
+func (td *TagDialect) Header() string {
+	return td.HeaderName
+}
+
+// Separator - Returns the separator between tags in the header value
+func (td *TagDialect) Separator() string {
+	return td.Sep
+}
+
+// SanitizeTag - Removes any character that isn't allowed by the dialect
+func (td *TagDialect) SanitizeTag(tag string) string {
+	if td.Allowed == nil {
+		return tag
+	}
+
+	return strings.Map(func(r rune) rune {
+		if td.Allowed(r) {
+			return r
+		}
+		return -1
+	}, tag)
+}
+
+// Limits - Returns the size limits of the dialect
+func (td *TagDialect) Limits() TagLimits {
+	return td.TagLimits
+}
+
+// VarnishDialect - "X-Cache-Channel", comma-separated. Varnish limits response headers to 8 KB by default (http_resp_hdr_len).
+var VarnishDialect Dialect = &TagDialect{
+	HeaderName: CacheChannelHeader,
+	Sep:        ", ",
+	Allowed:    isWordChar,
+	TagLimits:  TagLimits{MaxHeaderBytes: 8192},
+}
+
+// CloudflareDialect - "Cache-Tag" (Enterprise only), comma-separated without spaces.
+// Tags are limited to 1024 characters, and the header to 16 KB.
+var CloudflareDialect Dialect = &TagDialect{
+	HeaderName: CacheTagHeader,
+	Sep:        ",",
+	Allowed:    func(r rune) bool { return isPrintableASCII(r) && r != ',' },
+	TagLimits:  TagLimits{MaxTagLength: 1024, MaxHeaderBytes: 16 * 1024},
+}
+
+// FastlyDialect - "Surrogate-Key", space-separated.
+// Keys are limited to 1024 bytes, and the header to 16 KB.
+var FastlyDialect Dialect = &TagDialect{
+	HeaderName: SurrogateKeyHeader,
+	Sep:        " ",
+	Allowed:    isPrintableASCII,
+	TagLimits:  TagLimits{MaxTagLength: 1024, MaxHeaderBytes: 16 * 1024},
+}
+
+// AkamaiDialect - "Edge-Cache-Tag", comma-separated.
+// Tags are limited to 128 characters, and to 128 tags per object.
+// Allowed characters are alphanumerics and !#$%&'+-./^_`|~
+var AkamaiDialect Dialect = &TagDialect{
+	HeaderName: EdgeCacheTagHeader,
+	Sep:        ",",
+	Allowed: func(r rune) bool {
+		return isAlphanumeric(r) || strings.ContainsRune("!#$%&'+-./^_`|~", r)
+	},
+	TagLimits: TagLimits{MaxTagLength: 128, MaxTags: 128},
+}
+
+// isAlphanumeric - a-z, A-Z, 0-9
+func isAlphanumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// isWordChar - a-z, A-Z, 0-9, _, -
+func isWordChar(r rune) bool {
+	return isAlphanumeric(r) || r == '_' || r == '-'
+}
+
+// isPrintableASCII - Visible ASCII characters, ie. no spaces or control characters
+func isPrintableASCII(r rune) bool {
+	return r > ' ' && r < 0x7f
+}
+
+// OverflowReason - Describes how a tag list was altered to fit within the limits of a Dialect
+type OverflowReason string
+
+const (
+	OverflowDuplicate OverflowReason = "duplicate" // tags that became identical after sanitizing were merged
+	OverflowHashed    OverflowReason = "hashed"    // tags longer than MaxTagLength were shortened with a hash
+	OverflowDropped   OverflowReason = "dropped"   // the lowest priority tags were dropped, to respect MaxTags / MaxHeaderBytes
+)
+
+// Overflow - Reports tags that didn't fit within the limits of a Dialect. See CacheChannels.OnOverflow.
+type Overflow struct {
+	Header string         // the header of the dialect whose limits were exceeded
+	Reason OverflowReason // what was done about it
+	Tags   []string       // the affected tags, as they were before hashing / dropping
+}
+
+// tagHashLength - The length of the hex-encoded hash that shortens over-long tags
+const tagHashLength = 16
+
+// FormatTag - Formats a single tag the way it will be sent for the specified dialect:
+// sanitized, and shortened with a hash if it exceeds MaxTagLength.
+// Use it to find the purge key of a long channel.
+func FormatTag(d Dialect, tag string) string {
+	tag = d.SanitizeTag(tag)
+	maxLength := d.Limits().MaxTagLength
+	if maxLength <= 0 || len(tag) <= maxLength {
+		return tag
+	}
+
+	// keep as much of the original tag as possible (for readability), followed by a hash of the whole tag (for uniqueness)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(tag))
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if maxLength <= tagHashLength {
+		return sum[:maxLength]
+	}
+
+	// a sanitized tag may contain multi-byte characters, so cut it at a character boundary
+	prefix := tag[:maxLength-tagHashLength-1]
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+
+	if prefix == "" {
+		return sum // no room for any of the original tag
+	}
+
+	return d.SanitizeTag(prefix + "-" + sum)
+}
+
+// limitTags - Fits the tags within the limits of the dialect, in a deterministic way:
+//  1. sanitize, and merge tags that became identical
+//  2. shorten over-long tags with a hash
+//  3. drop the lowest priority tags (ie. the last ones) until both the tag count and the header size fit
+//
+// Returns the tags to send, along with a report of each overflow.
+func limitTags(d Dialect, tags []string) (kept []string, overflows []Overflow) {
+	limits := d.Limits()
+	sep := d.Separator()
+
+	var originals, duplicates, hashed []string
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		formatted := FormatTag(d, tag)
+		if formatted == "" {
+			continue
+		}
+
+		if seen[formatted] {
+			duplicates = append(duplicates, tag)
+			continue
+		}
+		seen[formatted] = true
+
+		if formatted != d.SanitizeTag(tag) {
+			hashed = append(hashed, tag)
+		}
+
+		kept = append(kept, formatted)
+		originals = append(originals, tag)
+	}
+
+	size := 0
+	for i, tag := range kept {
+		size += len(tag)
+		if i > 0 {
+			size += len(sep)
+		}
+
+		countExceeded := limits.MaxTags > 0 && i >= limits.MaxTags
+		sizeExceeded := limits.MaxHeaderBytes > 0 && size > limits.MaxHeaderBytes
+		if countExceeded || sizeExceeded {
+			overflows = append(overflows, Overflow{Header: d.Header(), Reason: OverflowDropped, Tags: originals[i:]})
+			kept = kept[:i:i]
+			break
+		}
+	}
+
+	if len(hashed) > 0 {
+		overflows = append([]Overflow{{Header: d.Header(), Reason: OverflowHashed, Tags: hashed}}, overflows...)
+	}
+
+	if len(duplicates) > 0 {
+		overflows = append([]Overflow{{Header: d.Header(), Reason: OverflowDuplicate, Tags: duplicates}}, overflows...)
+	}
+
+	return kept, overflows
+}
+
+// formatTags - Formats the tags according to the dialect, and reports anything that had to be altered to fit its limits
+func formatTags(d Dialect, tags []string) (string, []Overflow) {
+	kept, overflows := limitTags(d, tags)
+	return strings.Join(kept, d.Separator()), overflows
+}
@@ -0,0 +1,146 @@
+package cacheheaders
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDialects(t *testing.T) {
+	// a custom dialect, for a CDN that isn't built in
+	custom := &TagDialect{
+		HeaderName: "X-Custom-Tags",
+		Sep:        ";",
+		Allowed:    isAlphanumeric,
+		TagLimits:  TagLimits{MaxTags: 2},
+	}
+
+	cc := &CacheChannels{Varnish: true, Cloudflare: true, Dialects: []Dialect{FastlyDialect, AkamaiDialect, custom}}
+	cc.Set("article-123", "section_sport", "frontpage")
+
+	handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	expected := map[string]string{
+		CacheChannelHeader: "article-123, section_sport, frontpage",
+		CacheTagHeader:     "article-123,section_sport,frontpage",
+		SurrogateKeyHeader: "article-123 section_sport frontpage",
+		EdgeCacheTagHeader: "article-123,section_sport,frontpage",
+		"X-Custom-Tags":    "article123;sectionsport", // sanitized, and capped at two tags
+	}
+
+	for header, value := range expected {
+		if got := recorder.Header().Get(header); got != value {
+			t.Errorf("%s header mismatch!\nExpected: %v\nGot     : %v\n", header, value, got)
+		}
+	}
+}
+
+func TestFormatTagsLimits(t *testing.T) {
+	long := strings.Repeat("x", 129)
+
+	// Akamai: over-long tags are hashed, and the tag count is capped
+	tags := []string{"a", long, "b"}
+	for i := 0; i < 200; i++ {
+		tags = append(tags, fmt.Sprintf("t%d", i))
+	}
+
+	formatted, _ := formatTags(AkamaiDialect, tags)
+	got := strings.Split(formatted, ",")
+	if len(got) != 128 {
+		t.Errorf("Expected 128 Akamai tags, got %d", len(got))
+	}
+
+	if got[0] != "a" || got[2] != "b" || len(got[1]) != 128 {
+		t.Errorf("Expected the over-long tag to be hashed down to 128 characters, got %v", got[:3])
+	}
+
+	// Varnish: the header is capped at 8 KB
+	tags = nil
+	for i := 0; i < 1000; i++ {
+		tags = append(tags, fmt.Sprintf("channel-%d", i))
+	}
+
+	formatted, _ = formatTags(VarnishDialect, tags)
+	if n := len(formatted); n > 8192 {
+		t.Errorf("Varnish header is %d bytes, should be 8192 or less", n)
+	}
+}
+
+func TestFormatTagHashBoundaries(t *testing.T) {
+	tag := strings.Repeat("x", 40)
+	expected := map[int]string{
+		16: "",   // the hash, cut to size
+		17: "",   // the whole hash, without room for any of the tag
+		18: "x-", // one character of the tag, and the hash
+	}
+
+	for maxLength, prefix := range expected {
+		d := &TagDialect{HeaderName: "X-Tags", Sep: ",", Allowed: isWordChar, TagLimits: TagLimits{MaxTagLength: maxLength}}
+
+		got := FormatTag(d, tag)
+		if len(got) > maxLength || len(got) < tagHashLength || !strings.HasPrefix(got, prefix) || strings.HasPrefix(got, "-") {
+			t.Errorf("Unexpected tag for a max length of %d: %q", maxLength, got)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	long := strings.Repeat("section-", 20) // 160 characters, too long for Akamai
+
+	var overflows []Overflow
+	cc := &CacheChannels{Dialects: []Dialect{AkamaiDialect}, OnOverflow: func(r *http.Request, o Overflow) {
+		overflows = append(overflows, o)
+	}}
+
+	tags := []string{long, "a"}
+	for i := 0; i < 130; i++ {
+		tags = append(tags, fmt.Sprintf("tag-%d", i))
+	}
+	cc.Set(tags...)
+
+	handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddChannels(r.Context(), "a.b") // pruned to "ab" by AddChannels, so no duplicate of "a"
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	got := strings.Split(recorder.Header().Get(EdgeCacheTagHeader), ",")
+	if len(got) != 128 {
+		t.Fatalf("Expected 128 tags, got %d", len(got))
+	}
+
+	// the long tag keeps its priority, but is hashed down to size, deterministically
+	if got[0] != FormatTag(AkamaiDialect, long) || len(got[0]) != 128 || !strings.HasPrefix(got[0], "section-section-") {
+		t.Errorf("Unexpected hashed tag: %v", got[0])
+	}
+
+	if FormatTag(AkamaiDialect, long) == FormatTag(AkamaiDialect, long+"x") {
+		t.Errorf("Different long tags must not hash to the same tag")
+	}
+
+	expected := []Overflow{
+		{Header: EdgeCacheTagHeader, Reason: OverflowHashed, Tags: []string{long}},
+		{Header: EdgeCacheTagHeader, Reason: OverflowDropped, Tags: []string{"tag-126", "tag-127", "tag-128", "tag-129", "ab"}},
+	}
+
+	if !reflect.DeepEqual(overflows, expected) {
+		t.Errorf("Overflow mismatch!\nExpected: %v\nGot     : %v\n", expected, overflows)
+	}
+
+	// tags that become identical after sanitizing are merged
+	_, reported := limitTags(AkamaiDialect, []string{"a b", "ab"})
+	expected = []Overflow{{Header: EdgeCacheTagHeader, Reason: OverflowDuplicate, Tags: []string{"ab"}}}
+	if !reflect.DeepEqual(reported, expected) {
+		t.Errorf("Overflow mismatch!\nExpected: %v\nGot     : %v\n", expected, reported)
+	}
+}
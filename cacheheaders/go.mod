@@ -2,4 +2,7 @@ module github.com/dbmedialab/pkg/cacheheaders
 
 go 1.16
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/gorilla/mux v1.8.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,77 @@
+package cacheheaders
+
+import (
+	"strings"
+)
+
+// DirectiveClass - A coarse classification of a response's Cache-Control header, for metrics
+type DirectiveClass string
+
+const (
+	ClassNoStore   DirectiveClass = "no-store"  // not stored by any cache
+	ClassPrivate   DirectiveClass = "private"   // stored by browsers only
+	ClassNoCache   DirectiveClass = "no-cache"  // stored, but revalidated before every reuse
+	ClassCacheable DirectiveClass = "cacheable" // may be stored and reused by shared caches
+	ClassNone      DirectiveClass = "none"      // no Cache-Control header at all, which leaves it to the caches' heuristics
+)
+
+// Metrics - Receives measurements from the CacheControl and CacheChannels middlewares.
+// Implementations must be safe for concurrent use. See the cacheprom package for a Prometheus implementation.
+type Metrics interface {
+	// CountResponse - Called by CacheControl for every response, with the class of the Cache-Control header it was sent with
+	// and the class of its status code, eg. "2xx"
+	CountResponse(class DirectiveClass, statusClass string)
+
+	// ObserveChannels - Called by CacheChannels for every response, with the number of channels it carries
+	// (before any dialect limits are applied) and the class of its status code
+	ObserveChannels(count int, statusClass string)
+}
+
+// ClassifyDirectives - Returns the DirectiveClass of a Cache-Control header value
+func ClassifyDirectives(header string) DirectiveClass {
+	if strings.TrimSpace(header) == "" {
+		return ClassNone
+	}
+
+	class := ClassCacheable
+	for header != "" {
+		directive := header
+		if comma := strings.IndexByte(header, ','); comma >= 0 {
+			directive, header = header[:comma], header[comma+1:]
+		} else {
+			header = ""
+		}
+
+		// qualified private / no-cache only apply to some fields, so they don't change the class
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store":
+			return ClassNoStore
+		case "private":
+			class = ClassPrivate
+		case "no-cache":
+			if class != ClassPrivate {
+				class = ClassNoCache
+			}
+		}
+	}
+
+	return class
+}
+
+// statusClass - Returns the class of a status code, eg. "2xx"
+func statusClass(status int) string {
+	switch status / 100 {
+	case 1:
+		return "1xx"
+	case 2:
+		return "2xx"
+	case 3:
+		return "3xx"
+	case 4:
+		return "4xx"
+	case 5:
+		return "5xx"
+	}
+
+	return "other"
+}
@@ -0,0 +1,93 @@
+package cacheheaders
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testMetrics - A Metrics implementation that records what it's told
+type testMetrics struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	channels []string
+}
+
+func (m *testMetrics) CountResponse(class DirectiveClass, statusClass string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.counts == nil {
+		m.counts = map[string]int{}
+	}
+	m.counts[string(class)+" "+statusClass]++
+}
+
+func (m *testMetrics) ObserveChannels(count int, statusClass string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.channels = append(m.channels, fmt.Sprintf("%d %s", count, statusClass))
+}
+
+func TestClassifyDirectives(t *testing.T) {
+	tests := map[string]DirectiveClass{
+		"":                                 ClassNone,
+		"max-age=60, s-maxage=600":         ClassCacheable,
+		"public, immutable":                ClassCacheable,
+		"max-age=60, Private":              ClassPrivate,
+		`private="Set-Cookie", s-maxage=5`: ClassCacheable,
+		"no-cache":                         ClassNoCache,
+		"no-cache, private":                ClassPrivate,
+		"must-understand, no-store":        ClassNoStore,
+	}
+
+	for header, expected := range tests {
+		if got := ClassifyDirectives(header); got != expected {
+			t.Errorf("Directive class mismatch for %q!\nExpected: %v\nGot     : %v\n", header, expected, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &testMetrics{}
+
+	cc := &CacheControl{Metrics: metrics}
+	cc.SetSMaxAge(60)
+
+	channels := &CacheChannels{Varnish: true, Metrics: metrics}
+	channels.Set("frontpage")
+
+	handler := cc.SendHeaders(channels.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		AddChannels(r.Context(), "article-1", "article-2")
+		_, _ = w.Write([]byte("ok"))
+	})))
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	expected := map[string]int{"cacheable 2xx": 2, "cacheable 4xx": 1, "private 2xx": 1}
+	if fmt.Sprint(metrics.counts) != fmt.Sprint(expected) {
+		t.Errorf("Response counts mismatch!\nExpected: %v\nGot     : %v\n", expected, metrics.counts)
+	}
+
+	sort.Strings(metrics.channels)
+	expectedChannels := "1 4xx,3 2xx,3 2xx,3 2xx"
+	if got := strings.Join(metrics.channels, ","); got != expectedChannels {
+		t.Errorf("Channel observations mismatch!\nExpected: %v\nGot     : %v\n", expectedChannels, got)
+	}
+}
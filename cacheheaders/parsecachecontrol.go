@@ -0,0 +1,238 @@
+package cacheheaders
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxDeltaSeconds - The largest delta-seconds value. Larger values are clamped to this, as per RFC 9111 section 1.2.2,
+// which asks for 2^31: one second less, so that it fits in an int on 32-bit platforms.
+const maxDeltaSeconds = math.MaxInt32
+
+// ParseCacheControl - Parses a Cache-Control header value, eg. one returned by an upstream server.
+// Follows RFC 9111 section 5.2:
+//   - directive names are case-insensitive, arguments may be tokens or quoted strings
+//   - qualified "no-cache" and "private" take a (quoted) list of field names
+//   - when a directive occurs more than once, the first occurrence is used
+//   - unknown directives are kept as extensions, see CacheControl.Extensions
+//
+// Serializing the result with String produces an equivalent header,
+// although directives that have no effect (eg. a max-age next to no-store) are left out.
+// Use Validate on the result to check for contradictory directives.
+func ParseCacheControl(value string) (*CacheControl, error) {
+	cc := &CacheControl{}
+	seen := map[string]bool{}
+
+	p := &ccParser{s: value}
+	for {
+		p.skip(" \t,")
+		if p.done() {
+			break
+		}
+
+		name := p.token()
+		if name == "" {
+			return nil, p.errorf("expected a directive name")
+		}
+
+		arg, hasArg := "", false
+		p.skip(" \t")
+		if p.peek('=') {
+			p.pos++
+			p.skip(" \t")
+
+			var err error
+			if arg, err = p.argument(); err != nil {
+				return nil, err
+			}
+
+			hasArg = true
+			p.skip(" \t")
+		}
+
+		if !p.done() && !p.peek(',') {
+			return nil, p.errorf("expected a comma after the %q directive", name)
+		}
+
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue // the first occurrence wins
+		}
+		seen[name] = true
+
+		if err := cc.applyDirective(name, arg, hasArg); err != nil {
+			return nil, err
+		}
+	}
+
+	return cc, nil
+}
+
+// applyDirective - Applies a single parsed directive to the CacheControl configuration
+func (cc *CacheControl) applyDirective(name, arg string, hasArg bool) error {
+	switch name {
+	case "max-age", "s-maxage", "stale-while-revalidate", "stale-if-error":
+		seconds, err := parseDeltaSeconds(name, arg, hasArg)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case "max-age":
+			cc.SetMaxAge(seconds)
+		case "s-maxage":
+			cc.SetSMaxAge(seconds)
+		case "stale-while-revalidate":
+			cc.SetStaleWhileRevalidate(seconds)
+		case "stale-if-error":
+			cc.SetStaleIfError(seconds)
+		}
+
+	case "no-cache":
+		cc.SetNoCache(splitFieldList(arg)...)
+
+	case "private":
+		if fields := splitFieldList(arg); len(fields) > 0 {
+			cc.privateFields = fields
+		} else {
+			cc.Private = true
+		}
+
+	case "public":
+		cc.Public = true
+	case "no-store":
+		cc.NoStore = true
+	case "must-revalidate":
+		cc.MustRevalidate = true
+	case "proxy-revalidate":
+		cc.ProxyRevalidate = true
+	case "no-transform":
+		cc.NoTransform = true
+	case "immutable":
+		cc.Immutable = true
+	case "must-understand":
+		cc.MustUnderstand = true
+
+	default:
+		cc.AddExtension(Extension{Name: name, Value: arg, HasValue: hasArg})
+	}
+
+	return nil
+}
+
+// parseDeltaSeconds - Parses the argument of a directive that takes a number of seconds
+func parseDeltaSeconds(name, arg string, hasArg bool) (int, error) {
+	if !hasArg || arg == "" {
+		return 0, fmt.Errorf("cache-control: %s requires a number of seconds", name)
+	}
+
+	for _, c := range arg {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("cache-control: invalid %s value %q", name, arg)
+		}
+	}
+
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds > maxDeltaSeconds {
+		return maxDeltaSeconds, nil // only overflow is possible at this point
+	}
+
+	return int(seconds), nil
+}
+
+// splitFieldList - Splits the argument of a qualified no-cache / private directive into field names
+func splitFieldList(arg string) []string {
+	var fields []string
+	for _, field := range strings.Split(arg, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// quoteString - Returns s as a RFC 9110 quoted-string
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// ccParser - A minimal scanner for Cache-Control header values
+type ccParser struct {
+	s   string
+	pos int
+}
+
+// done - Checks whether the whole value has been consumed
+func (p *ccParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+// peek - Checks whether the next character is c
+func (p *ccParser) peek(c byte) bool {
+	return !p.done() && p.s[p.pos] == c
+}
+
+// skip - Skips past any of the specified characters
+func (p *ccParser) skip(chars string) {
+	for !p.done() && strings.IndexByte(chars, p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// token - Consumes and returns a token, which is empty if the next character isn't a token character
+func (p *ccParser) token() string {
+	start := p.pos
+	for !p.done() && isToken(p.s[p.pos:p.pos+1]) {
+		p.pos++
+	}
+
+	return p.s[start:p.pos]
+}
+
+// argument - Consumes and returns a directive argument, either a token or an (unquoted) quoted-string
+func (p *ccParser) argument() (string, error) {
+	if !p.peek('"') {
+		return p.token(), nil
+	}
+
+	p.pos++ // opening quote
+
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		p.pos++
+
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.done() {
+				return "", p.errorf("unterminated quoted-pair")
+			}
+			c = p.s[p.pos]
+			p.pos++
+		}
+
+		b.WriteByte(c)
+	}
+
+	return "", p.errorf("unterminated quoted string")
+}
+
+// errorf - Returns a parse error, annotated with the current position
+func (p *ccParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("cache-control: parse error at position %d in %q: %s", p.pos, p.s, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,122 @@
+package cacheheaders
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// our own output parses back to itself
+		{"max-age=30, private", "max-age=30, private"},
+		{"max-age=20, stale-while-revalidate=120, s-maxage=40", "max-age=20, stale-while-revalidate=120, s-maxage=40"},
+		{"must-understand, no-store", "must-understand, no-store"},
+		{`no-cache="Set-Cookie, X-Session", max-age=60`, `no-cache="Set-Cookie, X-Session", max-age=60`},
+
+		// case-insensitive names, odd whitespace and empty list elements
+		{"  Max-Age=60 ,, PUBLIC,S-MAXAGE=120  ", "public, max-age=60, s-maxage=120"},
+
+		// quoted arguments, where a token would do
+		{`max-age="60"`, "max-age=60"},
+		{`no-cache=Set-Cookie`, `no-cache="Set-Cookie"`},
+
+		// qualified private only affects the listed fields, so proxy directives are kept
+		{`private="Set-Cookie", s-maxage=60`, `private="Set-Cookie", s-maxage=60`},
+
+		// duplicates: the first occurrence wins
+		{"max-age=10, max-age=20", "max-age=10"},
+
+		// overflowing delta-seconds are clamped
+		{"max-age=99999999999999999999", "max-age=2147483647"},
+
+		// unknown extension directives are kept, in order
+		{`max-age=60, community="UCI", foo, max-stale=30, x-empty=""`, `max-age=60, community=UCI, foo, max-stale=30, x-empty=""`},
+		{`ext="a \"quoted\" value"`, `ext="a \"quoted\" value"`},
+
+		// no-store makes everything else irrelevant
+		{"no-store, max-age=0", "no-store"},
+
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		cc, err := ParseCacheControl(tt.input)
+		if err != nil {
+			t.Errorf("Unexpected error while parsing %q: %s", tt.input, err.Error())
+			continue
+		}
+
+		got := cc.String()
+		if got != tt.expected {
+			t.Errorf("Parse mismatch for %q!\nExpected: %v\nGot     : %v\n", tt.input, tt.expected, got)
+		}
+
+		// round trip: parsing the output again must produce the same header
+		again, err := ParseCacheControl(got)
+		if err != nil {
+			t.Errorf("Unexpected error while re-parsing %q: %s", got, err.Error())
+			continue
+		}
+
+		if again.String() != got {
+			t.Errorf("Round trip mismatch for %q!\nExpected: %v\nGot     : %v\n", tt.input, got, again.String())
+		}
+	}
+}
+
+func TestParseCacheControlValues(t *testing.T) {
+	cc, err := ParseCacheControl(`public, max-age=60, s-maxage=300, stale-if-error=600, no-cache="Set-Cookie", max-stale=10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cc.Public {
+		t.Errorf("Expected public to be set")
+	}
+
+	if v, ok := cc.MaxAge(); !ok || v != 60 {
+		t.Errorf("max-age mismatch: %d, %v", v, ok)
+	}
+
+	if v, ok := cc.SMaxAge(); !ok || v != 300 {
+		t.Errorf("s-maxage mismatch: %d, %v", v, ok)
+	}
+
+	if v, ok := cc.StaleIfError(); !ok || v != 600 {
+		t.Errorf("stale-if-error mismatch: %d, %v", v, ok)
+	}
+
+	if _, ok := cc.StaleWhileRevalidate(); ok {
+		t.Errorf("stale-while-revalidate shouldn't be set")
+	}
+
+	if fields, ok := cc.NoCache(); !ok || !reflect.DeepEqual(fields, []string{"Set-Cookie"}) {
+		t.Errorf("no-cache mismatch: %v, %v", fields, ok)
+	}
+
+	expected := []Extension{{Name: "max-stale", Value: "10", HasValue: true}}
+	if !reflect.DeepEqual(cc.Extensions(), expected) {
+		t.Errorf("Extensions mismatch!\nExpected: %v\nGot     : %v\n", expected, cc.Extensions())
+	}
+}
+
+func TestParseCacheControlErrors(t *testing.T) {
+	invalid := []string{
+		`max-age=abc`,
+		`max-age=-1`,
+		`max-age`,
+		`no-cache="Set-Cookie`,
+		`max-age=60 s-maxage=60`,
+		`=60`,
+		`private="a\`,
+	}
+
+	for _, input := range invalid {
+		if cc, err := ParseCacheControl(input); err == nil {
+			t.Errorf("Expected a parse error for %q, got %q", input, cc.String())
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package cacheheaders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy - A cache policy for the requests that match a path pattern and (optionally) a set of methods.
+// Policies are declared in a YAML or JSON config file, eg.
+//
+//	policies:
+//	  - name: article
+//	    path: /article/{id}
+//	    methods: [GET, HEAD]
+//	    cache_control: "max-age=60, s-maxage=600, stale-while-revalidate=30"
+//	    vary: [Accept-Encoding]
+//	    channels: [articles]
+//	  - name: static
+//	    path: /static/*
+//	    cache_control: "public, max-age=31536000, immutable"
+type Policy struct {
+	Name         string   `json:"name" yaml:"name"`                   // used in logs and errors
+	Path         string   `json:"path" yaml:"path"`                   // path pattern: literal segments, {param} segments and an optional trailing * (see PolicyTable.Match)
+	Methods      []string `json:"methods" yaml:"methods"`             // optional. If empty, the policy applies to every method.
+	CacheControl string   `json:"cache_control" yaml:"cache_control"` // Cache-Control directives, as sent in the header
+	Vary         []string `json:"vary" yaml:"vary"`                   // optional. Vary field names, see CacheControl.AddVary.
+	Channels     []string `json:"channels" yaml:"channels"`           // optional. Cache channels, added to the request like AddChannels does.
+
+	cc       *CacheControl
+	segments []string
+}
+
+// policyConfig - The root of a policy config file
+type policyConfig struct {
+	Policies []*Policy `json:"policies" yaml:"policies"`
+}
+
+// Control - Returns the CacheControl configuration of the policy. Only available for loaded policies.
+func (p *Policy) Control() *CacheControl {
+	return p.cc
+}
+
+// PolicyTable - A middleware struct that applies the best-matching Policy to each request,
+// based on a table of policies loaded from config.
+// The table can be reloaded at any time (see Load, LoadFile and WatchFile) without disturbing requests in flight:
+// each request uses the table that was current when it arrived.
+type PolicyTable struct {
+	// Channels - optional. Sends the channels of the matched policy (along with its own static channels and
+	// any channels added by the handler) with the CDN dialects configured on it.
+	// If nil, policy channels are only added to an existing collector, eg. from a CacheChannels.SendHeaders further out.
+	Channels *CacheChannels
+
+	policies atomic.Value // []*Policy, sorted from most to least specific
+}
+
+// LoadFile - Loads (or reloads) the policy table from a YAML or JSON file
+func (pt *PolicyTable) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return pt.Load(data)
+}
+
+// Load - Loads (or reloads) the policy table from YAML or JSON config.
+// The config is validated as a whole: if any policy is invalid, an error is returned and the current table is kept.
+func (pt *PolicyTable) Load(data []byte) error {
+	config := policyConfig{}
+
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&config)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&config)
+	}
+
+	if err != nil {
+		return fmt.Errorf("cache policies: %w", err)
+	}
+
+	seen := map[string]string{}
+	for i, p := range config.Policies {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		if err := p.compile(); err != nil {
+			return fmt.Errorf("cache policy %s: %w", p.Name, err)
+		}
+
+		methods := p.Methods
+		if len(methods) == 0 {
+			methods = []string{"*"}
+		}
+
+		for _, m := range methods {
+			key := p.pattern() + " " + m
+			if other, ok := seen[key]; ok {
+				return fmt.Errorf("cache policy %s: same path and method as policy %s", p.Name, other)
+			}
+			seen[key] = p.Name
+		}
+	}
+
+	sortPolicies(config.Policies)
+	pt.policies.Store(config.Policies)
+
+	return nil
+}
+
+// WatchFile - Loads a policy file, then polls it for changes and reloads the table whenever it changes. Blocks until the context is done.
+// Load errors (eg. a half-written or invalid file) are reported through onError, if set, and the current table is kept.
+func (pt *PolicyTable) WatchFile(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	var modTime time.Time
+	var size int64
+
+	if fi, err := os.Stat(path); err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+
+	if err := pt.LoadFile(path); err != nil && onError != nil {
+		onError(err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+
+		if fi.ModTime().Equal(modTime) && fi.Size() == size {
+			continue
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+
+		if err := pt.LoadFile(path); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Policies - Returns the loaded policies, from most to least specific
+func (pt *PolicyTable) Policies() []*Policy {
+	policies, _ := pt.policies.Load().([]*Policy)
+	return policies
+}
+
+// Match - Returns the best-matching policy for the request, or nil if none of them match.
+//
+// Path patterns consist of literal segments, {param} segments that match any single segment,
+// and an optional trailing * that matches the rest of the path (including nothing).
+// When several policies match, the most specific one wins: at the first segment where they differ,
+// a literal beats a {param}, which beats a *. Longer patterns beat shorter ones, except that a pattern
+// ending where a trailing * starts beats it (/news beats /news/* for /news), and policies that list the request method beat the ones that apply to every method.
+func (pt *PolicyTable) Match(r *http.Request) *Policy {
+	path := splitPath(r.URL.Path)
+	for _, p := range pt.Policies() {
+		if p.matches(r.Method, path) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// SendHeaders - A middleware function compatible with most routers.
+// Outputs cache headers and channels according to the best-matching policy. Requests without a matching policy are left alone.
+// A Cache-Control header set by the handler itself takes precedence over the policy.
+func (pt *PolicyTable) SendHeaders(next http.Handler) http.Handler {
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := pt.Match(r)
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		AddChannels(r.Context(), p.Channels...)
+		if info := debugInfoFrom(r.Context()); info != nil {
+			info.recordPolicy(p.Name)
+		}
+
+		requested := p.cc.requestTime()
+		hw := &headerWriter{ResponseWriter: w, before: func(h http.Header, status int) {
+			p.cc.writeHeaders(r, h, status, requested)
+		}}
+
+		next.ServeHTTP(hw, r)
+		hw.finalize(http.StatusOK) // the handler might not have written anything
+	}))
+
+	if pt.Channels != nil {
+		h = pt.Channels.SendHeaders(h)
+	}
+
+	return h
+}
+
+// compile - Validates the policy, and prepares it for matching
+func (p *Policy) compile() error {
+	if !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("path %q must start with a /", p.Path)
+	}
+
+	p.segments = splitPath(p.Path)
+	for i, seg := range p.segments {
+		if seg == "*" && i != len(p.segments)-1 {
+			return fmt.Errorf("path %q: * is only allowed as the last segment", p.Path)
+		}
+
+		if strings.HasPrefix(seg, "{") != strings.HasSuffix(seg, "}") {
+			return fmt.Errorf("path %q: malformed parameter segment %q", p.Path, seg)
+		}
+	}
+
+	for i, m := range p.Methods {
+		if !isToken(m) {
+			return fmt.Errorf("invalid method %q", m)
+		}
+		p.Methods[i] = strings.ToUpper(m)
+	}
+
+	cc, err := ParseCacheControl(p.CacheControl)
+	if err != nil {
+		return err
+	}
+
+	cc.AddVary(p.Vary...)
+	if err := cc.Validate(); err != nil {
+		return err
+	}
+	p.cc = cc
+
+	return nil
+}
+
+// pattern - Returns the path pattern with parameter names left out, so that equivalent patterns compare equal
+func (p *Policy) pattern() string {
+	segments := make([]string, len(p.segments))
+	for i, seg := range p.segments {
+		if isParam(seg) {
+			seg = "{}"
+		}
+		segments[i] = seg
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
+
+// matches - Checks whether the policy applies to the method and (split) path
+func (p *Policy) matches(method string, path []string) bool {
+	if len(p.Methods) > 0 && !containsString(p.Methods, method) {
+		return false
+	}
+
+	for i, seg := range p.segments {
+		if seg == "*" {
+			return true
+		}
+
+		if i >= len(path) {
+			return false
+		}
+
+		if !isParam(seg) && seg != path[i] {
+			return false
+		}
+	}
+
+	return len(path) == len(p.segments)
+}
+
+// sortPolicies - Sorts policies from most to least specific, see PolicyTable.Match
+func sortPolicies(policies []*Policy) {
+	kind := func(seg string) int {
+		switch {
+		case seg == "*":
+			return 0
+		case isParam(seg):
+			return 1
+		}
+		return 2
+	}
+
+	moreSpecific := func(a, b *Policy) bool {
+		for i := 0; i < len(a.segments) && i < len(b.segments); i++ {
+			if ka, kb := kind(a.segments[i]), kind(b.segments[i]); ka != kb {
+				return ka > kb
+			}
+		}
+
+		// one pattern is a prefix of the other. A trailing * also matches the end of the path, but the pattern that ends there is exact.
+		if la, lb := len(a.segments), len(b.segments); la < lb {
+			return b.segments[la] == "*"
+		} else if la > lb {
+			return a.segments[lb] != "*"
+		}
+
+		return len(a.Methods) > 0 && len(b.Methods) == 0
+	}
+
+	// insertion sort: stable, and policy tables are small
+	for i := 1; i < len(policies); i++ {
+		for j := i; j > 0 && moreSpecific(policies[j], policies[j-1]); j-- {
+			policies[j], policies[j-1] = policies[j-1], policies[j]
+		}
+	}
+}
+
+// splitPath - Splits a URL path into segments, ignoring leading and trailing slashes
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, "/")
+}
+
+// isParam - Checks whether a pattern segment is a {param}
+func isParam(seg string) bool {
+	return strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}")
+}
+
+// containsString - Checks whether the slice contains the string
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,202 @@
+package cacheheaders
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicies = `
+policies:
+  - name: article
+    path: /article/{id}
+    methods: [GET, HEAD]
+    cache_control: "max-age=60, s-maxage=600"
+    vary: [accept-encoding]
+    channels: [articles]
+  - name: article-latest
+    path: /article/latest
+    cache_control: "max-age=5"
+  - name: static
+    path: /static/*
+    cache_control: "public, max-age=31536000, immutable"
+  - name: default
+    path: /*
+    cache_control: "no-cache"
+`
+
+func TestPolicyTableMatch(t *testing.T) {
+	table := &PolicyTable{}
+	if err := table.Load([]byte(testPolicies)); err != nil {
+		t.Fatalf("Unexpected load error: %s", err.Error())
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{"GET", "/article/123", "article"},
+		{"HEAD", "/article/123/", "article"},
+		{"POST", "/article/123", "default"}, // article only applies to GET and HEAD
+		{"GET", "/article/latest", "article-latest"},
+		{"GET", "/article/123/comments", "default"},
+		{"GET", "/static/css/main.css", "static"},
+		{"GET", "/static", "static"},
+		{"GET", "/", "default"},
+	}
+
+	for _, tt := range tests {
+		p := table.Match(httptest.NewRequest(tt.method, tt.path, nil))
+		if p == nil || p.Name != tt.expected {
+			t.Errorf("Policy mismatch for %s %s!\nExpected: %v\nGot     : %v\n", tt.method, tt.path, tt.expected, p)
+		}
+	}
+
+	// an exact end of path beats a trailing *, whatever the order they're listed in
+	news := &PolicyTable{}
+	if err := news.Load([]byte(`{"policies": [
+		{"name": "section", "path": "/news/*", "cache_control": "max-age=60"},
+		{"name": "frontpage", "path": "/news", "cache_control": "max-age=5"}
+	]}`)); err != nil {
+		t.Fatalf("Unexpected load error: %s", err.Error())
+	}
+
+	for path, expected := range map[string]string{"/news": "frontpage", "/news/": "frontpage", "/news/sport": "section"} {
+		p := news.Match(httptest.NewRequest("GET", path, nil))
+		if p == nil || p.Name != expected {
+			t.Errorf("Policy mismatch for GET %s!\nExpected: %v\nGot     : %v\n", path, expected, p)
+		}
+	}
+}
+
+func TestPolicyTableSendHeaders(t *testing.T) {
+	table := &PolicyTable{Channels: &CacheChannels{Varnish: true}}
+	err := table.Load([]byte(`{"policies": [{"name": "article", "path": "/article/{id}", "cache_control": "max-age=60", "vary": ["Accept-Encoding"], "channels": ["articles"]}]}`))
+	if err != nil {
+		t.Fatalf("Unexpected load error: %s", err.Error())
+	}
+
+	handler := table.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddChannels(r.Context(), "article-123")
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/article/123", nil))
+
+	expected := map[string]string{
+		"Cache-Control":    "max-age=60",
+		"Vary":             "Accept-Encoding",
+		CacheChannelHeader: "articles, article-123",
+	}
+	for name, value := range expected {
+		if got := recorder.Header().Get(name); got != value {
+			t.Errorf("%s header mismatch!\nExpected: %v\nGot     : %v\n", name, value, got)
+		}
+	}
+
+	// unmatched requests are left alone
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/other", nil))
+	if got := recorder.Header().Get("Cache-Control"); got != "" {
+		t.Errorf("Expected no Cache-Control header for an unmatched request, got %q", got)
+	}
+}
+
+func TestPolicyTableValidation(t *testing.T) {
+	invalid := map[string]string{
+		"contradictory directives": `{"policies": [{"path": "/", "cache_control": "public, private"}]}`,
+		"unparseable directives":   `{"policies": [{"path": "/", "cache_control": "max-age=abc"}]}`,
+		"relative path":            `{"policies": [{"path": "article", "cache_control": "max-age=60"}]}`,
+		"wildcard not last":        `{"policies": [{"path": "/*/article", "cache_control": "max-age=60"}]}`,
+		"malformed parameter":      `{"policies": [{"path": "/article/{id", "cache_control": "max-age=60"}]}`,
+		"invalid method":           `{"policies": [{"path": "/", "methods": ["G ET"], "cache_control": "max-age=60"}]}`,
+		"duplicate":                `{"policies": [{"path": "/a/{id}", "cache_control": "max-age=60"}, {"path": "/a/{slug}/", "cache_control": "max-age=5"}]}`,
+		"unknown field":            "policies:\n  - path: /\n    max_age: 60\n",
+	}
+
+	for name, config := range invalid {
+		table := &PolicyTable{}
+		if err := table.Load([]byte(testPolicies)); err != nil {
+			t.Fatalf("Unexpected load error: %s", err.Error())
+		}
+
+		if err := table.Load([]byte(config)); err == nil {
+			t.Errorf("Expected a load error for %s", name)
+		}
+
+		// the previous table is kept
+		if len(table.Policies()) != 4 {
+			t.Errorf("Expected the previous policies to be kept after a failed load (%s), got %d policies", name, len(table.Policies()))
+		}
+	}
+}
+
+func TestPolicyTableWatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policytable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policies.yaml")
+	write := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("policies:\n  - path: /\n    cache_control: max-age=60\n", now.Add(-time.Hour))
+
+	table := &PolicyTable{}
+	if err := table.LoadFile(path); err != nil {
+		t.Fatalf("Unexpected load error: %s", err.Error())
+	}
+
+	errs := make(chan error, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go table.WatchFile(ctx, path, 5*time.Millisecond, func(err error) { errs <- err })
+
+	current := func() string {
+		return table.Match(httptest.NewRequest("GET", "/", nil)).Control().String()
+	}
+
+	write("policies:\n  - path: /\n    cache_control: max-age=5\n", now.Add(-time.Minute))
+	waitFor(t, func() bool { return current() == "max-age=5" })
+
+	// an invalid file is reported, and doesn't replace the current table
+	write("policies:\n  - path: /\n    cache_control: public, private\n", now)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected an error for an invalid policy file")
+	}
+
+	if got := current(); got != "max-age=5" {
+		t.Errorf("Cache Control mismatch after an invalid reload!\nExpected: %v\nGot     : %v\n", "max-age=5", got)
+	}
+}
+
+// waitFor - Polls the condition until it's true, or fails the test after a second
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,361 @@
+package cacheheaders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Purger - Purges cached responses from a cache proxy or CDN, by the cache channels that CacheChannels emitted for them
+type Purger interface {
+	Purge(ctx context.Context, channels ...string) error
+}
+
+// PurgeOptions - Batching, retry and concurrency settings shared by the Purger implementations.
+// The zero value is usable: every unset field falls back to a sensible default.
+type PurgeOptions struct {
+	Naming    ChannelNaming // the naming of the CacheChannels that sent the channels, so that purges target the channels as they were sent
+	Client    *http.Client  // defaults to http.DefaultClient
+	BatchSize int           // max channels per purge request. Defaults to the max allowed by the API.
+	Workers   int           // max concurrent purge requests. Defaults to 4.
+	Attempts  int           // max attempts per batch, including the first one. Defaults to 3.
+	Backoff   time.Duration // delay before the first retry, doubled for every retry after that. Defaults to 500ms.
+}
+
+// PurgeError - Returned when one or more batches failed, even after retrying
+type PurgeError struct {
+	Channels []string // the channels that may not have been purged
+	Err      error    // the error of the first failed batch
+}
+
+// Error - Implements the error interface
+func (pe *PurgeError) Error() string {
+	return fmt.Sprintf("purge failed for %d channels: %s", len(pe.Channels), pe.Err.Error())
+}
+
+// Unwrap - Returns the error of the first failed batch
+func (pe *PurgeError) Unwrap() error {
+	return pe.Err
+}
+
+// statusError - An unexpected response status from a purge API
+type statusError struct {
+	status int
+	body   string
+}
+
+// Error - Implements the error interface
+func (se *statusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d: %s", se.status, se.body)
+}
+
+// retryable - Reports whether a failed purge request is worth retrying.
+// Transport errors, rate limiting and server errors are; other client errors won't go away by themselves.
+func retryable(err error) bool {
+	se, ok := err.(*statusError)
+	if !ok {
+		return true
+	}
+
+	return se.status == http.StatusTooManyRequests || se.status >= 500
+}
+
+// client - Returns the configured http.Client, or the default one
+func (po PurgeOptions) client() *http.Client {
+	if po.Client != nil {
+		return po.Client
+	}
+
+	return http.DefaultClient
+}
+
+// purgeBatch - A batch of purge keys, and the endpoint to send them to
+type purgeBatch struct {
+	endpoint string
+	keys     []string
+}
+
+// batches - Splits the keys into batches for the endpoint, of at most BatchSize (or maxBatch) keys each
+func (po PurgeOptions) batches(endpoint string, keys []string, maxBatch int) []purgeBatch {
+	size := po.BatchSize
+	if size <= 0 || size > maxBatch {
+		size = maxBatch
+	}
+
+	var batches []purgeBatch
+	for len(keys) > 0 {
+		n := size
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		batches = append(batches, purgeBatch{endpoint: endpoint, keys: keys[:n]})
+		keys = keys[n:]
+	}
+
+	return batches
+}
+
+// run - Sends the batches with a bounded number of workers, retrying each one with exponential backoff
+func (po PurgeOptions) run(ctx context.Context, batches []purgeBatch, send func(ctx context.Context, b purgeBatch) error) error {
+	workers := po.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		perr  *PurgeError
+		queue = make(chan purgeBatch)
+	)
+
+	for i := 0; i < workers && i < len(batches); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range queue {
+				err := po.retry(ctx, b, send)
+				if err == nil {
+					continue
+				}
+
+				mu.Lock()
+				if perr == nil {
+					perr = &PurgeError{Err: err}
+				}
+				perr.Channels = append(perr.Channels, b.keys...)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, b := range batches {
+		queue <- b
+	}
+	close(queue)
+	wg.Wait()
+
+	if perr != nil {
+		return perr
+	}
+
+	return nil
+}
+
+// retry - Sends a single batch, retrying with exponential backoff
+func (po PurgeOptions) retry(ctx context.Context, b purgeBatch, send func(ctx context.Context, b purgeBatch) error) error {
+	attempts := po.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	backoff := po.Backoff
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = send(ctx, b); err == nil || attempt >= attempts || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// do - Sends a purge request, and turns unexpected response statuses into errors
+func (po PurgeOptions) do(req *http.Request) ([]byte, error) {
+	res, err := po.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &statusError{status: res.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+
+	return body, nil
+}
+
+// formatPurgeKeys - Formats the channels the same way CacheChannels sends them for the dialect,
+// so that namespaced channels are purged with their namespace, and long channels by their hashed tag
+func formatPurgeKeys(d Dialect, naming ChannelNaming, channels []string) []string {
+	keys := make([]string, 0, len(channels))
+	seen := make(map[string]bool, len(channels))
+	for _, ch := range channels {
+		key := FormatTag(d, naming.key(ch))
+		if key == "" || seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// VarnishPurger - Bans cached objects from one or more Varnish servers, by matching their "X-Cache-Channel" header.
+// Sends a BAN request with the regex in the "X-Cache-Channel" header, which the VCL is expected to pass on to ban(), eg.
+//
+//	if (req.method == "BAN") {
+//	    ban("obj.http.X-Cache-Channel ~ " + req.http.X-Cache-Channel);
+//	    return (synth(200, "Banned"));
+//	}
+type VarnishPurger struct {
+	Endpoints []string // URLs of the Varnish servers, eg. "http://varnish-1:6081/"
+	PurgeOptions
+}
+
+// varnishMaxBatch - Keeps the ban regex well within Varnish's default request header limit (8 KB)
+const varnishMaxBatch = 100
+
+// Purge - Bans every object that has at least one of the channels, on every server
+func (vp *VarnishPurger) Purge(ctx context.Context, channels ...string) error {
+	keys := formatPurgeKeys(VarnishDialect, vp.Naming, channels)
+
+	// every server gets its own batches, so that a slow or failing server doesn't hold back the others
+	var batches []purgeBatch
+	for _, endpoint := range vp.Endpoints {
+		batches = append(batches, vp.batches(endpoint, keys, varnishMaxBatch)...)
+	}
+
+	return vp.run(ctx, batches, func(ctx context.Context, b purgeBatch) error {
+		req, err := http.NewRequest("BAN", b.endpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set(CacheChannelHeader, banRegex(b.keys))
+		_, err = vp.do(req.WithContext(ctx))
+		return err
+	})
+}
+
+// banRegex - Returns a regex that matches a comma-separated channel list containing at least one of the channels
+func banRegex(channels []string) string {
+	quoted := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		quoted = append(quoted, regexp.QuoteMeta(ch))
+	}
+
+	return `(^|,\s*)(` + strings.Join(quoted, "|") + `)(\s*,|$)`
+}
+
+// CloudflarePurger - Purges cached objects from Cloudflare by "Cache-Tag" (Enterprise only), through the purge_cache API.
+type CloudflarePurger struct {
+	ZoneID   string // the zone (website) to purge
+	APIToken string // an API token with the Cache Purge permission
+	BaseURL  string // defaults to https://api.cloudflare.com/client/v4
+	PurgeOptions
+}
+
+// cloudflareMaxBatch - The max number of tags per purge_cache request
+const cloudflareMaxBatch = 30
+
+// Purge - Purges every object that has at least one of the channels as a cache tag
+func (cp *CloudflarePurger) Purge(ctx context.Context, channels ...string) error {
+	baseURL := cp.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.cloudflare.com/client/v4"
+	}
+	endpoint := strings.TrimRight(baseURL, "/") + "/zones/" + cp.ZoneID + "/purge_cache"
+
+	keys := formatPurgeKeys(CloudflareDialect, cp.Naming, channels)
+	return cp.run(ctx, cp.batches(endpoint, keys, cloudflareMaxBatch), func(ctx context.Context, b purgeBatch) error {
+		payload, err := json.Marshal(map[string][]string{"tags": b.keys})
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, b.endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+cp.APIToken)
+		req.Header.Set("Content-Type", "application/json")
+
+		body, err := cp.do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+
+		result := struct {
+			Success bool `json:"success"`
+			Errors  []struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		}{}
+
+		if err := json.Unmarshal(body, &result); err != nil {
+			return fmt.Errorf("cloudflare: unexpected response: %w", err)
+		}
+
+		if !result.Success {
+			return fmt.Errorf("cloudflare: purge unsuccessful: %+v", result.Errors)
+		}
+
+		return nil
+	})
+}
+
+// FastlyPurger - Purges cached objects from Fastly by "Surrogate-Key", through the purge API.
+type FastlyPurger struct {
+	ServiceID string // the service to purge
+	APIKey    string // an API token with the purge_select scope
+	BaseURL   string // defaults to https://api.fastly.com
+	SoftPurge bool   // if true, objects are marked as stale instead of being removed, so stale-while-revalidate / stale-if-error still apply
+	PurgeOptions
+}
+
+// fastlyMaxBatch - The max number of surrogate keys per purge request
+const fastlyMaxBatch = 256
+
+// Purge - Purges every object that has at least one of the channels as a surrogate key
+func (fp *FastlyPurger) Purge(ctx context.Context, channels ...string) error {
+	baseURL := fp.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.fastly.com"
+	}
+	endpoint := strings.TrimRight(baseURL, "/") + "/service/" + fp.ServiceID + "/purge"
+
+	keys := formatPurgeKeys(FastlyDialect, fp.Naming, channels)
+	return fp.run(ctx, fp.batches(endpoint, keys, fastlyMaxBatch), func(ctx context.Context, b purgeBatch) error {
+		req, err := http.NewRequest(http.MethodPost, b.endpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Fastly-Key", fp.APIKey)
+		req.Header.Set(SurrogateKeyHeader, strings.Join(b.keys, " "))
+		if fp.SoftPurge {
+			req.Header.Set("Fastly-Soft-Purge", "1")
+		}
+
+		_, err = fp.do(req.WithContext(ctx))
+		return err
+	})
+}
@@ -0,0 +1,216 @@
+package cacheheaders
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVarnishPurger(t *testing.T) {
+	var mu sync.Mutex
+	bans := map[string][]string{} // server => ban regexes
+
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "BAN" {
+				t.Errorf("Expected a BAN request, got %s", r.Method)
+			}
+
+			mu.Lock()
+			bans[name] = append(bans[name], r.Header.Get(CacheChannelHeader))
+			mu.Unlock()
+		}))
+	}
+
+	v1, v2 := newServer("v1"), newServer("v2")
+	defer v1.Close()
+	defer v2.Close()
+
+	vp := &VarnishPurger{Endpoints: []string{v1.URL, v2.URL}}
+	if err := vp.Purge(context.Background(), "article-123", "section.sport"); err != nil {
+		t.Fatalf("Unexpected purge error: %s", err.Error())
+	}
+
+	for _, server := range []string{"v1", "v2"} {
+		if len(bans[server]) != 1 {
+			t.Fatalf("Expected 1 ban on %s, got %d", server, len(bans[server]))
+		}
+
+		rx := regexp.MustCompile(bans[server][0])
+
+		// the regex must match whole channels in the header sent by CacheChannels, and nothing else
+		matches := map[string]bool{
+			"article-123":                         true,
+			"frontpage, article-123":              true,
+			"frontpage, sectionsport, article-12": true,
+			"frontpage, article-1234":             false,
+			"xarticle-123, section-sport":         false,
+		}
+
+		for header, expected := range matches {
+			if rx.MatchString(header) != expected {
+				t.Errorf("Ban regex %q: expected match=%v for %q", bans[server][0], expected, header)
+			}
+		}
+	}
+}
+
+func TestCloudflarePurger(t *testing.T) {
+	var mu sync.Mutex
+	var purged []string
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if r.URL.Path != "/zones/zone-1/purge_cache" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Unexpected Authorization header: %s", r.Header.Get("Authorization"))
+		}
+
+		payload := struct {
+			Tags []string `json:"tags"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Failed to decode payload: %s", err.Error())
+		}
+
+		if len(payload.Tags) > cloudflareMaxBatch {
+			t.Errorf("Batch too large: %d tags", len(payload.Tags))
+		}
+
+		mu.Lock()
+		purged = append(purged, payload.Tags...)
+		mu.Unlock()
+
+		_, _ = w.Write([]byte(`{"success": true, "errors": [], "result": {"id": "zone-1"}}`))
+	}))
+	defer server.Close()
+
+	var channels []string
+	for i := 0; i < 75; i++ {
+		channels = append(channels, fmt.Sprintf("article-%d", i))
+	}
+
+	cp := &CloudflarePurger{ZoneID: "zone-1", APIToken: "token", BaseURL: server.URL}
+	if err := cp.Purge(context.Background(), channels...); err != nil {
+		t.Fatalf("Unexpected purge error: %s", err.Error())
+	}
+
+	if requests != 3 {
+		t.Errorf("Expected 3 batches, got %d", requests)
+	}
+
+	sort.Strings(purged)
+	sort.Strings(channels)
+	if strings.Join(purged, ",") != strings.Join(channels, ",") {
+		t.Errorf("Purged tags mismatch!\nExpected: %v\nGot     : %v\n", channels, purged)
+	}
+
+	// an unsuccessful API response is an error, even with a 200
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"success": false, "errors": [{"code": 1134, "message": "Purge by tag is not available"}]}`))
+	}))
+	defer failing.Close()
+
+	cp = &CloudflarePurger{ZoneID: "zone-1", BaseURL: failing.URL, PurgeOptions: PurgeOptions{Attempts: 1}}
+	if err := cp.Purge(context.Background(), "article-1"); err == nil {
+		t.Errorf("Expected an error for an unsuccessful purge")
+	}
+}
+
+func TestFastlyPurger(t *testing.T) {
+	var attempts int32
+	var keys string
+
+	// fails twice with a 503 before succeeding
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.URL.Path != "/service/svc-1/purge" || r.Header.Get("Fastly-Key") != "key" || r.Header.Get("Fastly-Soft-Purge") != "1" {
+			t.Errorf("Unexpected request: %s %v", r.URL.Path, r.Header)
+		}
+
+		keys = r.Header.Get(SurrogateKeyHeader)
+		_, _ = w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer server.Close()
+
+	fp := &FastlyPurger{ServiceID: "svc-1", APIKey: "key", BaseURL: server.URL, SoftPurge: true, PurgeOptions: PurgeOptions{Backoff: time.Millisecond}}
+	if err := fp.Purge(context.Background(), "article-1", "article-2"); err != nil {
+		t.Fatalf("Unexpected purge error: %s", err.Error())
+	}
+
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+
+	if keys != "article-1 article-2" {
+		t.Errorf("Surrogate-Key mismatch!\nExpected: %v\nGot     : %v\n", "article-1 article-2", keys)
+	}
+}
+
+func TestPurgeRetryAndConcurrency(t *testing.T) {
+	var active, maxActive, requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+
+		for {
+			prev := atomic.LoadInt32(&maxActive)
+			if n <= prev || atomic.CompareAndSwapInt32(&maxActive, prev, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		if strings.Contains(r.Header.Get(SurrogateKeyHeader), "forbidden") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	var channels []string
+	for i := 0; i < 20; i++ {
+		channels = append(channels, fmt.Sprintf("ch-%d", i))
+	}
+	channels = append(channels, "forbidden")
+
+	opts := PurgeOptions{BatchSize: 1, Workers: 3, Backoff: time.Millisecond}
+	fp := &FastlyPurger{ServiceID: "svc", BaseURL: server.URL, PurgeOptions: opts}
+
+	err := fp.Purge(context.Background(), channels...)
+
+	var perr *PurgeError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected a PurgeError, got %v", err)
+	}
+
+	// a 403 is not retried
+	if len(perr.Channels) != 1 || perr.Channels[0] != "forbidden" || requests != 21 {
+		t.Errorf("Expected only the forbidden channel to fail, without retries. Failed: %v, requests: %d", perr.Channels, requests)
+	}
+
+	if maxActive > 3 {
+		t.Errorf("Expected at most 3 concurrent requests, got %d", maxActive)
+	}
+}
@@ -0,0 +1,716 @@
+package cacheheaders
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache-Status: Used by caches to tell how they handled the request (RFC 9211)
+const CacheStatusHeader = "Cache-Status"
+
+// ResponseCache - A middleware struct that stores responses in memory, as a shared cache would (RFC 9111).
+// Meant for small services without a cache proxy in front of them, so that the directives set by CacheControl still pay off.
+//
+// Responses are stored according to their Cache-Control header: they need an s-maxage or max-age,
+// and must not be private, no-store or no-cache (qualified private / no-cache fields are stored without those fields).
+// Responses with Set-Cookie or Vary: * are never stored. Stale responses are served for the stale-while-revalidate period
+// while a single background request revalidates them, and concurrent misses for the same response are collapsed into one request.
+// Once a response turns out not to be storable, the requests waiting for it are released, and the following ones skip the wait
+// for the HitForMiss period. Upgrade requests (eg. websockets) are never cached.
+//
+// Cached responses are indexed by the channels added through CacheChannels.Add / AddChannels, and can be purged by them,
+// since ResponseCache implements Purger. Successful unsafe requests (POST, PUT, DELETE...) invalidate the responses for their URL.
+//
+// Use it as the outermost middleware, so that it stores the headers produced by the others:
+//
+//	r.Use(rc.Handler, ctrl.SendHeaders, channels.SendHeaders)
+type ResponseCache struct {
+	MaxEntries  int             // optional. The max number of stored responses, the least recently used ones are evicted first. Defaults to 1000.
+	MaxBodySize int             // optional. Responses with a larger body aren't stored. Defaults to 1 MB.
+	KeyOptions  CacheKeyOptions // optional. How requests are turned into cache keys, see CacheKey. The Vary field is ignored: it's taken from the stored responses.
+	Name        string          // optional. Identifies the cache in the Cache-Status header. Defaults to "cacheheaders".
+	Clock       Clock           // optional. Defaults to the system clock.
+	Naming      ChannelNaming   // optional. The naming of the CacheChannels behind it, so that Purge finds the channels as they were sent.
+
+	// HitForMiss - optional. How long requests for a response that couldn't be stored go straight to the handler,
+	// instead of waiting for each other (eg. server-sent events, or other long-lived responses). Defaults to 2 minutes.
+	HitForMiss time.Duration
+
+	// Bypass - optional. Requests for which it returns true are passed straight through, without looking them up or storing the response.
+	// Defaults to requests with an Authorization header or a session cookie (see DefaultSafetyRules),
+	// since users that are logged in shouldn't get the responses stored for everyone else.
+	Bypass func(r *http.Request) bool
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry     // stored responses, by cache key
+	uris     map[string]*uriEntries     // the stored variants of each URL, by cache key without Vary
+	channels map[string]map[string]bool // cache keys, by channel
+	flights  map[string]*flight         // requests in progress to the origin, by cache key
+	misses   map[string]time.Time       // when the hit-for-miss period of the responses that couldn't be stored ends, by cache key
+	lru      *list.List                 // of *cacheEntry, most recently used first
+}
+
+// cacheEntry - A stored response
+type cacheEntry struct {
+	key          string
+	uri          string
+	status       int
+	header       http.Header
+	body         []byte
+	requestTime  time.Time     // when the request that produced the response was received
+	responseTime time.Time     // when the response was complete
+	ttl          time.Duration // freshness lifetime, from s-maxage or max-age
+	stale        time.Duration // how long a stale response may still be served while revalidating, from stale-while-revalidate
+	channels     []string
+	elem         *list.Element
+}
+
+// uriEntries - The stored variants of a URL, and the Vary field names that tell them apart
+type uriEntries struct {
+	vary *Vary
+	keys map[string]bool
+}
+
+// flight - A request to the origin in progress, that other requests for the same response can wait for
+type flight struct {
+	done  chan struct{}
+	once  sync.Once
+	entry *cacheEntry // the stored response, or nil if it couldn't be stored. Set before done is closed.
+}
+
+// cacheableStatus - The status codes that ResponseCache stores, given explicit freshness (RFC 9110 section 15.1)
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+// Handler - A middleware function compatible with most routers. Serves stored responses, and stores new ones, see ResponseCache.
+func (rc *ResponseCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !safeMethod(r.Method) {
+			hw := &headerWriter{ResponseWriter: w, before: func(h http.Header, status int) {
+				if status < 400 {
+					rc.invalidate(r)
+				}
+			}}
+
+			next.ServeHTTP(hw, r)
+			hw.finalize(http.StatusOK)
+			return
+		}
+
+		uri, err := CacheKey(r, rc.keyOptions(nil))
+		if err != nil || r.Method != http.MethodGet && r.Method != http.MethodHead || r.Header.Get("Upgrade") != "" || rc.bypass(r) {
+			w.Header().Set(CacheStatusHeader, rc.name()+"; fwd=bypass")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rc.mu.Lock()
+		vary := rc.varyOf(uri)
+		rc.mu.Unlock()
+
+		key := uri
+		if vary != nil {
+			if key, err = CacheKey(r, rc.keyOptions(vary)); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		rc.mu.Lock()
+		rc.init()
+
+		if e := rc.entries[key]; e != nil {
+			now := rc.now()
+			age := CurrentAge(e.header, e.requestTime, e.responseTime, now)
+
+			if age < e.ttl+e.stale {
+				rc.lru.MoveToFront(e.elem)
+				if age >= e.ttl && rc.flights[key] == nil {
+					rc.revalidate(next, r, uri, e)
+				}
+				rc.mu.Unlock()
+
+				rc.serve(w, r, e, age)
+				return
+			}
+		}
+
+		// a response that couldn't be stored recently: don't make the requests wait for each other
+		if until, ok := rc.misses[key]; ok {
+			if rc.now().Before(until) {
+				rc.mu.Unlock()
+
+				w.Header().Set(CacheStatusHeader, rc.name()+"; fwd=miss")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			delete(rc.misses, key)
+		}
+
+		// a miss: wait for the request that is already fetching the response, or fetch it
+		if f := rc.flights[key]; f != nil {
+			rc.mu.Unlock()
+
+			select {
+			case <-f.done:
+			case <-r.Context().Done():
+				return
+			}
+
+			if e := f.entry; e != nil && rc.matches(r, e) {
+				rc.serve(w, r, e, CurrentAge(e.header, e.requestTime, e.responseTime, rc.now()))
+				return
+			}
+
+			// the response can't be shared, so this request needs one of its own
+			w.Header().Set(CacheStatusHeader, rc.name()+"; fwd=miss")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		f := &flight{done: make(chan struct{})}
+		rc.flights[key] = f
+		rc.mu.Unlock()
+
+		w.Header().Set(CacheStatusHeader, rc.name()+"; fwd=miss")
+		if r.Method == http.MethodHead {
+			defer rc.land(key, f, nil)
+			next.ServeHTTP(w, r) // there's no body to store
+			return
+		}
+
+		// landed even if the handler panics (eg. with http.ErrAbortHandler), or the requests waiting for it would wait forever
+		var e *cacheEntry
+		defer func() { rc.land(key, f, e) }()
+
+		e = rc.fetch(next, w, r, uri, key, f)
+	})
+}
+
+// Purge - Removes the stored responses that have at least one of the channels. Implements Purger.
+func (rc *ResponseCache) Purge(ctx context.Context, channels ...string) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.init()
+	for _, ch := range channels {
+		for key := range rc.channels[rc.Naming.key(ch)] {
+			rc.remove(rc.entries[key])
+		}
+	}
+
+	return nil
+}
+
+// Len - Returns the number of stored responses
+func (rc *ResponseCache) Len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return len(rc.entries)
+}
+
+// fetch - Passes the request on to the origin, and stores the response if possible.
+// If w is nil, the response is only stored, eg. when revalidating in the background.
+// As soon as the headers show that the response can't be stored, the flight is landed, so that the requests waiting for it
+// don't have to wait for the whole response, and the key gets a hit-for-miss period.
+func (rc *ResponseCache) fetch(next http.Handler, w http.ResponseWriter, r *http.Request, uri, key string, f *flight) *cacheEntry {
+	col, ok := r.Context().Value(channelCollectorKey{}).(*channelCollector)
+	if !ok {
+		// collect the channels of the response, like CacheChannels.SendHeaders does (and will, sharing this collector)
+		col = &channelCollector{}
+		r = r.WithContext(context.WithValue(r.Context(), channelCollectorKey{}, col))
+	}
+
+	requestTime := rc.now()
+	cw := &captureWriter{w: w, header: http.Header{}, limit: rc.maxBodySize(), before: func(h http.Header, status int) {
+		if _, _, _, ok := storable(h, status); !ok {
+			rc.miss(key)
+			rc.land(key, f, nil)
+		}
+	}}
+
+	next.ServeHTTP(cw, r)
+	cw.WriteHeader(http.StatusOK) // the handler might not have written anything
+
+	e := rc.store(r, uri, cw, col.list(), requestTime)
+	if e == nil {
+		rc.miss(key)
+	}
+
+	return e
+}
+
+// storable - Checks the status and headers of a response, and returns its parsed Cache-Control header,
+// its freshness lifetime and stale-while-revalidate period (in seconds) if it can be stored
+func storable(h http.Header, status int) (*CacheControl, int, int, bool) {
+	if !cacheableStatus[status] || len(h.Values("Set-Cookie")) > 0 {
+		return nil, 0, 0, false
+	}
+
+	cc, err := ParseCacheControl(strings.Join(h.Values("Cache-Control"), ", "))
+	if err != nil || cc.NoStore || cc.Private {
+		return nil, 0, 0, false
+	}
+
+	if noCacheFields, noCache := cc.NoCache(); noCache && len(noCacheFields) == 0 {
+		return nil, 0, 0, false // every reuse would need revalidation
+	}
+
+	ttl, ok := cc.SMaxAge()
+	if !ok {
+		if ttl, ok = cc.MaxAge(); !ok {
+			return nil, 0, 0, false // no heuristic freshness
+		}
+	}
+
+	stale, _ := cc.StaleWhileRevalidate()
+	if cc.MustRevalidate || cc.ProxyRevalidate {
+		stale = 0
+	}
+
+	if ttl <= 0 && stale <= 0 {
+		return nil, 0, 0, false
+	}
+
+	return cc, ttl, stale, true
+}
+
+// miss - Starts the hit-for-miss period of a cache key
+func (rc *ResponseCache) miss(key string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.init()
+	now := rc.now()
+	if len(rc.misses) >= rc.maxEntries() {
+		for k, until := range rc.misses {
+			if !now.Before(until) {
+				delete(rc.misses, k)
+			}
+		}
+	}
+
+	if len(rc.misses) < rc.maxEntries() {
+		rc.misses[key] = now.Add(rc.hitForMiss())
+	}
+}
+
+// store - Stores a captured response, if its status and headers allow it
+func (rc *ResponseCache) store(r *http.Request, uri string, cw *captureWriter, channels []string, requestTime time.Time) *cacheEntry {
+	h := cw.header
+	cc, ttl, stale, ok := storable(h, cw.status)
+	if cw.overflow || !ok {
+		return nil
+	}
+
+	vary := ParseVary(h.Values("Vary")...)
+	key, err := CacheKey(r, rc.keyOptions(vary))
+	if err != nil {
+		return nil // Vary: *
+	}
+
+	noCacheFields, _ := cc.NoCache()
+	header := h.Clone()
+	for _, field := range append(noCacheFields, cc.PrivateFields()...) {
+		header.Del(field)
+	}
+	header.Del(CacheStatusHeader)
+	header.Del(CachePolicyDebugHeader) // only meant for the request that asked for it
+
+	e := &cacheEntry{
+		key:          key,
+		uri:          uri,
+		status:       cw.status,
+		header:       header,
+		body:         append([]byte(nil), cw.body.Bytes()...),
+		requestTime:  requestTime,
+		responseTime: rc.now(),
+		ttl:          time.Duration(ttl) * time.Second,
+		stale:        time.Duration(stale) * time.Second,
+		channels:     channels,
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.init()
+	rc.add(e, vary)
+
+	return e
+}
+
+// revalidate - Fetches a fresh copy of a stale response in the background. The caller must hold rc.mu.
+func (rc *ResponseCache) revalidate(next http.Handler, r *http.Request, uri string, stale *cacheEntry) {
+	f := &flight{done: make(chan struct{})}
+	rc.flights[stale.key] = f
+
+	r = r.Clone(context.Background()) // the original request ends before the revalidation does
+	go func() {
+		var e *cacheEntry
+		defer func() {
+			// there's no net/http server to recover a panicking handler here, so it would take the whole process down
+			_ = recover()
+			rc.land(stale.key, f, e)
+
+			if e == nil {
+				// the response can't be stored anymore (or the handler failed), so the stale one must go too
+				rc.mu.Lock()
+				if rc.entries[stale.key] == stale {
+					rc.remove(stale)
+				}
+				rc.mu.Unlock()
+			}
+		}()
+
+		e = rc.fetch(next, nil, r, uri, stale.key, f)
+	}()
+}
+
+// land - Ends a flight with the stored response (or nil), and releases the requests waiting for it. Only the first call counts.
+func (rc *ResponseCache) land(key string, f *flight, e *cacheEntry) {
+	f.once.Do(func() {
+		rc.mu.Lock()
+		if rc.flights[key] == f {
+			delete(rc.flights, key)
+		}
+		rc.mu.Unlock()
+
+		f.entry = e
+		close(f.done)
+	})
+}
+
+// serve - Writes a stored response
+func (rc *ResponseCache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, age time.Duration) {
+	h := w.Header()
+	for name, values := range e.header {
+		h[name] = append([]string(nil), values...)
+	}
+
+	SetAge(h, age)
+	h.Set(CacheStatusHeader, rc.name()+"; hit; ttl="+strconv.Itoa(int((e.ttl-age)/time.Second)))
+
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// matches - Checks whether a stored response can be used for the request, ie. whether the request has the same cache key
+func (rc *ResponseCache) matches(r *http.Request, e *cacheEntry) bool {
+	rc.mu.Lock()
+	vary := rc.varyOf(e.uri)
+	rc.mu.Unlock()
+
+	key, err := CacheKey(r, rc.keyOptions(vary))
+	return err == nil && key == e.key
+}
+
+// invalidate - Removes the stored responses for the URL of an unsafe request (RFC 9111 section 4.4)
+func (rc *ResponseCache) invalidate(r *http.Request) {
+	uri, err := CacheKey(r, rc.keyOptions(nil))
+	if err != nil {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if u := rc.uris[uri]; u != nil {
+		for key := range u.keys {
+			rc.remove(rc.entries[key])
+		}
+	}
+}
+
+// add - Stores an entry, replacing any variants of its URL that vary on other request headers. The caller must hold rc.mu.
+func (rc *ResponseCache) add(e *cacheEntry, vary *Vary) {
+	u := rc.uris[e.uri]
+	if u != nil && u.vary.String() != vary.String() {
+		for key := range u.keys {
+			rc.remove(rc.entries[key])
+		}
+		u = nil
+	}
+
+	if u == nil {
+		u = &uriEntries{vary: vary, keys: map[string]bool{}}
+		rc.uris[e.uri] = u
+	}
+
+	if old := rc.entries[e.key]; old != nil {
+		rc.remove(old)
+		rc.uris[e.uri] = u // removing the last variant removed the URL too
+	}
+
+	rc.entries[e.key] = e
+	u.keys[e.key] = true
+	e.elem = rc.lru.PushFront(e)
+
+	for _, ch := range e.channels {
+		if rc.channels[ch] == nil {
+			rc.channels[ch] = map[string]bool{}
+		}
+		rc.channels[ch][e.key] = true
+	}
+
+	for rc.lru.Len() > rc.maxEntries() {
+		rc.remove(rc.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// remove - Removes an entry from the cache and its indexes. The caller must hold rc.mu.
+func (rc *ResponseCache) remove(e *cacheEntry) {
+	if e == nil || rc.entries[e.key] != e {
+		return
+	}
+
+	delete(rc.entries, e.key)
+	rc.lru.Remove(e.elem)
+
+	for _, ch := range e.channels {
+		delete(rc.channels[ch], e.key)
+		if len(rc.channels[ch]) == 0 {
+			delete(rc.channels, ch)
+		}
+	}
+
+	if u := rc.uris[e.uri]; u != nil {
+		delete(u.keys, e.key)
+		if len(u.keys) == 0 {
+			delete(rc.uris, e.uri)
+		}
+	}
+}
+
+// varyOf - Returns the Vary field names of the stored variants of a URL, or nil if there are none. The caller must hold rc.mu.
+func (rc *ResponseCache) varyOf(uri string) *Vary {
+	if u := rc.uris[uri]; u != nil && !u.vary.Empty() {
+		return u.vary
+	}
+
+	return nil
+}
+
+// init - Initializes the maps on first use. The caller must hold rc.mu.
+func (rc *ResponseCache) init() {
+	if rc.entries != nil {
+		return
+	}
+
+	rc.entries = map[string]*cacheEntry{}
+	rc.uris = map[string]*uriEntries{}
+	rc.channels = map[string]map[string]bool{}
+	rc.flights = map[string]*flight{}
+	rc.misses = map[string]time.Time{}
+	rc.lru = list.New()
+}
+
+// keyOptions - Returns the cache key options for a response with the Vary field names
+func (rc *ResponseCache) keyOptions(vary *Vary) CacheKeyOptions {
+	opts := rc.KeyOptions
+	opts.Vary = vary
+
+	return opts
+}
+
+// bypass - Checks whether the request should skip the cache
+func (rc *ResponseCache) bypass(r *http.Request) bool {
+	if rc.Bypass != nil {
+		return rc.Bypass(r)
+	}
+
+	if cc := r.Header.Get("Cache-Control"); strings.Contains(cc, "no-store") {
+		return true
+	}
+
+	return r.Header.Get("Authorization") != "" || DefaultSafetyRules.hasSessionCookie(r)
+}
+
+// now - Returns the current time according to the configured clock
+func (rc *ResponseCache) now() time.Time {
+	if rc.Clock != nil {
+		return rc.Clock.Now()
+	}
+
+	return systemClock.Now()
+}
+
+// name - Returns the name of the cache in the Cache-Status header
+func (rc *ResponseCache) name() string {
+	if rc.Name != "" {
+		return rc.Name
+	}
+
+	return "cacheheaders"
+}
+
+// maxEntries - Returns the configured max number of entries, or the default
+func (rc *ResponseCache) maxEntries() int {
+	if rc.MaxEntries > 0 {
+		return rc.MaxEntries
+	}
+
+	return 1000
+}
+
+// hitForMiss - Returns the configured hit-for-miss period, or the default
+func (rc *ResponseCache) hitForMiss() time.Duration {
+	if rc.HitForMiss > 0 {
+		return rc.HitForMiss
+	}
+
+	return 2 * time.Minute
+}
+
+// maxBodySize - Returns the configured max body size, or the default
+func (rc *ResponseCache) maxBodySize() int {
+	if rc.MaxBodySize > 0 {
+		return rc.MaxBodySize
+	}
+
+	return 1 << 20
+}
+
+// captureWriter - A http.ResponseWriter that records a response for the cache, while (optionally) passing it on to the client.
+// Passes through http.Flusher, http.Hijacker, http.Pusher and io.ReaderFrom, like headerWriter does.
+type captureWriter struct {
+	w        http.ResponseWriter // optional. The client's ResponseWriter.
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	limit    int
+	before   func(h http.Header, status int) // optional. Called with the headers, before they're sent.
+	overflow bool                            // the body grew larger than the limit (or the connection was hijacked), so the response can't be stored
+}
+
+// Header - Returns the headers of the recorded response
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+// WriteHeader - Records the status code, and sends the headers to the client.
+// Informational responses (eg. 103 Early Hints) are only sent to the client, they aren't the status of the response.
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+
+	if informational(status) {
+		if cw.w != nil {
+			h := cw.w.Header()
+			for name, values := range cw.header {
+				h[name] = values
+			}
+
+			cw.w.WriteHeader(status)
+		}
+		return
+	}
+
+	cw.status = status
+	if cw.before != nil {
+		cw.before(cw.header, status)
+	}
+
+	if cw.w != nil {
+		h := cw.w.Header()
+		for name, values := range cw.header {
+			h[name] = values
+		}
+
+		cw.w.WriteHeader(status)
+	}
+}
+
+// Write - Records the body, and sends it to the client
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.WriteHeader(http.StatusOK)
+
+	if !cw.overflow {
+		if cw.body.Len()+len(b) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+
+	if cw.w == nil {
+		return len(b), nil
+	}
+
+	return cw.w.Write(b)
+}
+
+// Flush - Sends any buffered data to the client, if the client's ResponseWriter supports it
+func (cw *captureWriter) Flush() {
+	cw.WriteHeader(http.StatusOK)
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack - Lets the handler take over the client's connection, eg. for websocket upgrades. The response isn't stored.
+func (cw *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	cw.overflow, cw.body = true, bytes.Buffer{}
+	return h.Hijack()
+}
+
+// Push - Initiates a HTTP/2 server push, if the client's ResponseWriter supports it
+func (cw *captureWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := cw.w.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return p.Push(target, opts)
+}
+
+// ReadFrom - Records the body up to the limit, then hands the rest over to the client's io.ReaderFrom (eg. sendfile), if any
+func (cw *captureWriter) ReadFrom(r io.Reader) (int64, error) {
+	cw.WriteHeader(http.StatusOK)
+
+	var n int64
+	if !cw.overflow {
+		// one byte past the limit tells a body that fits from one that doesn't
+		copied, err := io.Copy(writerOnly{cw}, io.LimitReader(r, int64(cw.limit-cw.body.Len()+1)))
+		if n = copied; err != nil || !cw.overflow {
+			return n, err
+		}
+	}
+
+	var rest int64
+	var err error
+	switch w := cw.w.(type) {
+	case nil:
+		rest, err = io.Copy(ioutil.Discard, r)
+	case io.ReaderFrom:
+		rest, err = w.ReadFrom(r)
+	default:
+		rest, err = io.Copy(writerOnly{w}, r)
+	}
+
+	return n + rest, err
+}
+
+// Unwrap - Returns the client's ResponseWriter, for use by http.ResponseController
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.w
+}
@@ -0,0 +1,452 @@
+package cacheheaders
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock - A Clock that only moves when told to
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// cacheTest - Sets up a ResponseCache in front of CacheControl, CacheChannels and a counting origin handler
+type cacheTest struct {
+	rc       *ResponseCache
+	clock    *testClock
+	requests int32
+	handler  http.Handler
+}
+
+func newCacheTest(ctrl *CacheControl, origin http.HandlerFunc) *cacheTest {
+	ct := &cacheTest{clock: &testClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}}
+	ct.rc = &ResponseCache{Clock: ct.clock}
+
+	channels := &CacheChannels{Varnish: true}
+	counting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&ct.requests, 1)
+		w.Header().Set("X-Version", fmt.Sprint(n))
+		origin(w, r)
+	})
+
+	ct.handler = ct.rc.Handler(ctrl.SendHeaders(channels.SendHeaders(counting)))
+	return ct
+}
+
+func (ct *cacheTest) get(path string, header http.Header) *http.Response {
+	r := httptest.NewRequest("GET", path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	recorder := httptest.NewRecorder()
+	ct.handler.ServeHTTP(recorder, r)
+
+	return recorder.Result()
+}
+
+func TestResponseCache(t *testing.T) {
+	ctrl := &CacheControl{}
+	ctrl.SetMaxAge(5)
+	ctrl.SetSMaxAge(10)
+	ctrl.SetStaleWhileRevalidate(30)
+
+	ct := newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("article"))
+	})
+
+	expect := func(step string, res *http.Response, version, age, status string) {
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != "article" {
+			t.Errorf("%s: Body mismatch!\nExpected: %v\nGot     : %v\n", step, "article", string(body))
+		}
+
+		got := fmt.Sprintf("version=%s age=%s status=%s", res.Header.Get("X-Version"), res.Header.Get("Age"), res.Header.Get(CacheStatusHeader))
+		expected := fmt.Sprintf("version=%s age=%s status=%s", version, age, status)
+		if got != expected {
+			t.Errorf("%s: Response mismatch!\nExpected: %v\nGot     : %v\n", step, expected, got)
+		}
+	}
+
+	expect("miss", ct.get("/article/1", nil), "1", "", "cacheheaders; fwd=miss")
+	expect("hit", ct.get("/article/1?utm_source=newsletter", nil), "1", "0", "cacheheaders; hit; ttl=10")
+
+	ct.clock.Advance(4 * time.Second)
+	expect("aged hit", ct.get("/article/1", nil), "1", "4", "cacheheaders; hit; ttl=6")
+
+	// stale: served while a single background request revalidates it
+	ct.clock.Advance(11 * time.Second)
+	expect("stale", ct.get("/article/1", nil), "1", "15", "cacheheaders; hit; ttl=-5")
+	waitFor(t, func() bool { return atomic.LoadInt32(&ct.requests) == 2 && ct.rc.Len() == 1 })
+	waitFor(t, func() bool { return ct.get("/article/1", nil).Header.Get("X-Version") == "2" })
+
+	// past stale-while-revalidate, it's a miss
+	ct.clock.Advance(time.Minute)
+	expect("expired", ct.get("/article/1", nil), "3", "", "cacheheaders; fwd=miss")
+
+	if requests := atomic.LoadInt32(&ct.requests); requests != 3 {
+		t.Errorf("Expected 3 requests to the origin, got %d", requests)
+	}
+}
+
+func TestResponseCacheCollapsing(t *testing.T) {
+	ctrl := &CacheControl{}
+	ctrl.SetSMaxAge(60)
+
+	release := make(chan struct{})
+	ct := newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte("slow"))
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := ioutil.ReadAll(ct.get("/slow", nil).Body)
+			if string(body) != "slow" {
+				t.Errorf("Body mismatch!\nExpected: %v\nGot     : %v\n", "slow", string(body))
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond) // let the requests pile up
+	close(release)
+	wg.Wait()
+
+	if requests := atomic.LoadInt32(&ct.requests); requests != 1 {
+		t.Errorf("Expected the concurrent misses to be collapsed into 1 request to the origin, got %d", requests)
+	}
+}
+
+func TestResponseCacheHitForMiss(t *testing.T) {
+	ctrl := &CacheControl{}
+	ctrl.SetSMaxAge(60)
+
+	// server-sent events: the headers tell that the response can't be stored long before it ends
+	release := make(chan struct{})
+	ct := newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-release
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ct.get("/events", nil)
+		}()
+	}
+
+	// none of them waits for the others
+	waitFor(t, func() bool { return atomic.LoadInt32(&ct.requests) == 3 })
+	close(release)
+	wg.Wait()
+
+	// too large to be stored: the following requests go straight to the origin for the hit-for-miss period
+	release = make(chan struct{})
+	ct = newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ct.requests) > 1 {
+			<-release
+		}
+		_, _ = w.Write([]byte(strings.Repeat("x", 5000)))
+	})
+	ct.rc.MaxBodySize = 1024
+	ct.rc.HitForMiss = time.Minute
+
+	ct.get("/large", nil)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := ct.get("/large", nil).Header.Get(CacheStatusHeader); got != "cacheheaders; fwd=miss" {
+				t.Errorf("Cache Status mismatch!\nExpected: %v\nGot     : %v\n", "cacheheaders; fwd=miss", got)
+			}
+		}()
+	}
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&ct.requests) == 3 })
+	close(release)
+	wg.Wait()
+
+	// past the hit-for-miss period, the next response gets a new one
+	ct.clock.Advance(2 * time.Minute)
+	ct.get("/large", nil)
+
+	ct.rc.mu.Lock()
+	defer ct.rc.mu.Unlock()
+	for key, until := range ct.rc.misses {
+		if !until.After(ct.clock.Now()) {
+			t.Errorf("Expected a new hit-for-miss period for %s, got one that ended at %v", key, until)
+		}
+	}
+	if len(ct.rc.misses) != 1 {
+		t.Errorf("Expected 1 hit-for-miss period, got %d", len(ct.rc.misses))
+	}
+}
+
+func TestResponseCachePanic(t *testing.T) {
+	ctrl := &CacheControl{}
+	ctrl.SetSMaxAge(10)
+	ctrl.SetStaleWhileRevalidate(60)
+
+	var panicking int32
+	ct := newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&panicking) == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = w.Write([]byte("article"))
+	})
+
+	get := func() (res *http.Response, panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		return ct.get("/article/1", nil), false
+	}
+
+	// a panicking handler doesn't leave the following requests waiting for its flight
+	atomic.StoreInt32(&panicking, 1)
+	if _, panicked := get(); !panicked {
+		t.Errorf("Expected the handler's panic to be passed on")
+	}
+
+	atomic.StoreInt32(&panicking, 0)
+	done := make(chan *http.Response)
+	go func() {
+		res, _ := get()
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != "article" {
+			t.Errorf("Body mismatch!\nExpected: %v\nGot     : %v\n", "article", string(body))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The request after a panicking one is still waiting")
+	}
+
+	// a panic while revalidating in the background is recovered, and the stale response is dropped
+	atomic.StoreInt32(&panicking, 1)
+	ct.clock.Advance(20 * time.Second)
+	if res, _ := get(); res.Header.Get("X-Version") != "2" {
+		t.Errorf("Expected the stale response, got version %q", res.Header.Get("X-Version"))
+	}
+
+	waitFor(t, func() bool { return ct.rc.Len() == 0 })
+}
+
+func TestResponseCacheUpgrade(t *testing.T) {
+	ctrl := &CacheControl{}
+	ctrl.SetSMaxAge(60)
+
+	ct := newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {})
+	upgrade := http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}
+
+	for i := 0; i < 2; i++ {
+		if got := ct.get("/socket", upgrade).Header.Get(CacheStatusHeader); got != "cacheheaders; fwd=bypass" {
+			t.Errorf("Cache Status mismatch!\nExpected: %v\nGot     : %v\n", "cacheheaders; fwd=bypass", got)
+		}
+	}
+
+	if requests := atomic.LoadInt32(&ct.requests); requests != 2 || ct.rc.Len() != 0 {
+		t.Errorf("Expected upgrade requests to bypass the cache, got %d requests to the origin and %d stored responses", requests, ct.rc.Len())
+	}
+}
+
+func TestResponseCacheInvalidation(t *testing.T) {
+	ctrl := &CacheControl{}
+	ctrl.SetSMaxAge(60)
+
+	ct := newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		AddChannels(r.Context(), "article-"+r.URL.Path[len("/article/"):])
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ct.get("/article/1", nil)
+	ct.get("/article/2", nil)
+	if ct.rc.Len() != 2 {
+		t.Fatalf("Expected 2 stored responses, got %d", ct.rc.Len())
+	}
+
+	// the ResponseCache is a Purger, with the same channels as CacheChannels
+	var purger Purger = ct.rc
+	if err := purger.Purge(context.Background(), "article-1"); err != nil {
+		t.Fatalf("Unexpected purge error: %s", err.Error())
+	}
+
+	if ct.rc.Len() != 1 || ct.get("/article/2", nil).Header.Get("X-Version") != "2" {
+		t.Errorf("Expected only article-1 to be purged")
+	}
+
+	// successful unsafe requests invalidate their URL
+	recorder := httptest.NewRecorder()
+	ct.handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/article/2", nil))
+
+	if ct.rc.Len() != 0 {
+		t.Errorf("Expected the POST to invalidate the stored response, got %d stored responses", ct.rc.Len())
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	ctrl := &CacheControl{}
+	ctrl.SetSMaxAge(60)
+	ctrl.AddVary("Accept-Language")
+
+	ct := newCacheTest(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+
+	for _, lang := range []string{"nb", "en", "nb", "en"} {
+		body, _ := ioutil.ReadAll(ct.get("/", http.Header{"Accept-Language": {lang}}).Body)
+		if string(body) != lang {
+			t.Errorf("Body mismatch!\nExpected: %v\nGot     : %v\n", lang, string(body))
+		}
+	}
+
+	if requests := atomic.LoadInt32(&ct.requests); requests != 2 {
+		t.Errorf("Expected 1 request to the origin per variant, got %d", requests)
+	}
+}
+
+func TestResponseCacheNotStored(t *testing.T) {
+	cacheable := &CacheControl{}
+	cacheable.SetSMaxAge(60)
+
+	private := &CacheControl{Private: true}
+	private.SetMaxAge(60)
+
+	tests := []struct {
+		name   string
+		ctrl   *CacheControl
+		header http.Header
+		origin http.HandlerFunc
+	}{
+		{"private", private, nil, func(w http.ResponseWriter, r *http.Request) {}},
+		{"no-store", &CacheControl{NoStore: true}, nil, func(w http.ResponseWriter, r *http.Request) {}},
+		{"no freshness", &CacheControl{}, nil, func(w http.ResponseWriter, r *http.Request) {}},
+		{"server error", cacheable, nil, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}},
+		{"authorization", cacheable, http.Header{"Authorization": {"Bearer token"}}, func(w http.ResponseWriter, r *http.Request) {}},
+		{"vary wildcard", cacheable, nil, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Vary", "*")
+		}},
+	}
+
+	for _, tt := range tests {
+		ct := newCacheTest(tt.ctrl, tt.origin)
+		ct.get("/", tt.header)
+		ct.get("/", tt.header)
+
+		if requests := atomic.LoadInt32(&ct.requests); requests != 2 || ct.rc.Len() != 0 {
+			t.Errorf("%s: Expected the response not to be stored, got %d requests to the origin and %d stored responses", tt.name, requests, ct.rc.Len())
+		}
+	}
+}
+
+func TestResponseCachePassThrough(t *testing.T) {
+	rc := &ResponseCache{MaxBodySize: 1024}
+
+	ctrl := &CacheControl{}
+	ctrl.SetSMaxAge(60)
+
+	var requests int32
+	routes := http.NewServeMux()
+
+	// large bodies are copied through io.ReaderFrom, and not stored
+	routes.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader(strings.Repeat("x", 5000)))
+	})
+
+	// small ones are stored
+	routes.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader("small"))
+	})
+
+	// websocket-style upgrade: the connection is hijacked and written to directly
+	routes.HandleFunc("/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack error: %s", err.Error())
+			return
+		}
+		defer conn.Close()
+
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+	})
+
+	server := httptest.NewServer(rc.Handler(ctrl.SendHeaders(routes)))
+	defer server.Close()
+
+	get := func(path string) string {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		if body := get("/file"); len(body) != 5000 {
+			t.Errorf("Expected a 5000 byte body, got %d bytes", len(body))
+		}
+		if body := get("/small"); body != "small" {
+			t.Errorf("Body mismatch!\nExpected: %v\nGot     : %v\n", "small", body)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 3 || rc.Len() != 1 {
+		t.Errorf("Expected only the small response to be stored, got %d requests and %d stored responses", n, rc.Len())
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/upgrade", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Status mismatch!\nExpected: %v\nGot     : %v\n", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+}
@@ -0,0 +1,105 @@
+package cacheheaders
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// headerWriter - A http.ResponseWriter wrapper that runs a callback right before the response headers are sent.
+// Lets the middleware finalize its headers after the handler has had its say (status code, headers set by the handler etc).
+//
+// Passes through http.Flusher, http.Hijacker, http.Pusher and io.ReaderFrom,
+// so that streaming handlers and websocket upgrades keep working behind the middleware.
+// If the underlying ResponseWriter lacks one of them, Hijack and Push return an error, while Flush is a no-op.
+type headerWriter struct {
+	http.ResponseWriter
+	before  func(h http.Header, status int) // called once, before the first WriteHeader / Write
+	written bool
+}
+
+// WriteHeader - Finalizes the headers, then sends the status code.
+// Informational responses (eg. 103 Early Hints) are sent as they are: the headers are finalized for the final status.
+func (hw *headerWriter) WriteHeader(status int) {
+	if informational(status) {
+		hw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	hw.finalize(status)
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+// Write - Finalizes the headers, then writes the body
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	hw.finalize(http.StatusOK)
+	return hw.ResponseWriter.Write(b)
+}
+
+// Flush - Finalizes the headers, then flushes any buffered data to the client
+func (hw *headerWriter) Flush() {
+	hw.finalize(http.StatusOK)
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack - Lets the handler take over the connection, eg. for websocket upgrades.
+// No headers are finalized, since the response is no longer written through net/http.
+func (hw *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := hw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	hw.written = true // the callback must not run on a hijacked connection
+	return h.Hijack()
+}
+
+// Push - Initiates a HTTP/2 server push. Doesn't affect the headers of the current response.
+func (hw *headerWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := hw.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return p.Push(target, opts)
+}
+
+// ReadFrom - Finalizes the headers, then copies the reader into the response,
+// using the underlying io.ReaderFrom (eg. sendfile) if there is one.
+func (hw *headerWriter) ReadFrom(r io.Reader) (int64, error) {
+	hw.finalize(http.StatusOK)
+	if rf, ok := hw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+
+	// hide our own ReadFrom from io.Copy, or it would end up calling itself
+	return io.Copy(writerOnly{hw.ResponseWriter}, r)
+}
+
+// Unwrap - Returns the underlying ResponseWriter, for use by http.ResponseController
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// informational - Reports whether a status is an informational one that precedes the final response, ie. 1xx but 101 Switching Protocols
+func informational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+// finalize - Runs the callback with the response status, unless it has already been run
+func (hw *headerWriter) finalize(status int) {
+	if hw.written {
+		return
+	}
+
+	hw.written = true
+	hw.before(hw.ResponseWriter.Header(), status)
+}
+
+// writerOnly - Hides every method except Write
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,214 @@
+package cacheheaders
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// TestDeferredHeaders - ensures that the headers are finalized when the response starts, not before the handler runs
+func TestDeferredHeaders(t *testing.T) {
+	cc := &CacheControl{}
+	cc.SetMaxAge(30)
+
+	// the handler overrides the configured directives
+	handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := w.Header().Get("Cache-Control"); got != "" {
+			t.Errorf("Cache-Control was set before the handler ran: %v", got)
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	if got := recorder.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", "no-store", got)
+	}
+
+	// the handler doesn't write anything at all
+	handler = cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	if got := recorder.Header().Get("Cache-Control"); got != "max-age=30" {
+		t.Errorf("Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", "max-age=30", got)
+	}
+}
+
+// TestPassThrough - ensures that the optional ResponseWriter interfaces survive the middleware
+func TestPassThrough(t *testing.T) {
+	cc := &CacheControl{}
+	cc.SetMaxAge(30)
+	chans := &CacheChannels{Varnish: true}
+	chans.Set("stream")
+
+	routes := http.NewServeMux()
+
+	// streaming: the headers must be in place when the first chunk is flushed
+	routes.Handle("/stream", cc.SendHeaders(chans.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Errorf("ResponseWriter doesn't implement http.Flusher")
+			return
+		}
+
+		f.Flush()
+		_, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader("chunk"))
+	}))))
+
+	// websocket-style upgrade: the connection is hijacked and written to directly
+	routes.Handle("/upgrade", cc.SendHeaders(chans.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := w.(http.Hijacker)
+		if !ok {
+			t.Errorf("ResponseWriter doesn't implement http.Hijacker")
+			return
+		}
+
+		conn, buf, err := h.Hijack()
+		if err != nil {
+			t.Errorf("Hijack error: %s", err.Error())
+			return
+		}
+		defer conn.Close()
+
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+	}))))
+
+	server := httptest.NewServer(routes)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if got := res.Header.Get("Cache-Control"); got != "max-age=30" {
+		t.Errorf("Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", "max-age=30", got)
+	}
+	if got := res.Header.Get(CacheChannelHeader); got != "stream" {
+		t.Errorf("Cache Channel header mismatch!\nExpected: %v\nGot     : %v\n", "stream", got)
+	}
+	if string(body) != "chunk" {
+		t.Errorf("Body mismatch!\nExpected: %v\nGot     : %v\n", "chunk", string(body))
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/upgrade", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Status mismatch!\nExpected: %v\nGot     : %v\n", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+	if got := res.Header.Get("Cache-Control"); got != "" {
+		t.Errorf("Cache-Control was sent on a hijacked connection: %v", got)
+	}
+}
+
+// TestInformationalResponses - ensures that the headers are finalized for the final status, not for a 103 Early Hints
+func TestInformationalResponses(t *testing.T) {
+	cc := &CacheControl{}
+	cc.SetMaxAge(60)
+	cc.SetSMaxAge(60)
+
+	rc := &ResponseCache{}
+	cond := &Conditional{}
+	handler := rc.Handler(cond.Handler(cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		}
+		_, _ = w.Write([]byte("body"))
+	}))))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(path string) (*http.Response, int) {
+		hints := 0
+		trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints++
+			return nil
+		}}
+
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res, hints
+	}
+
+	// the cookie set after the 103 is seen by the safety rules
+	res, hints := get("/login")
+	if got := res.Header.Get("Cache-Control"); got != "max-age=60, private" || hints != 1 {
+		t.Errorf("Cache Control header mismatch!\nExpected: %v\nGot     : %v (%d early hints)\n", "max-age=60, private", got, hints)
+	}
+
+	// the 200 gets an ETag, and is stored
+	res, hints = get("/")
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") == "" || hints != 1 {
+		t.Errorf("Unexpected response: %d, ETag %q (%d early hints)", res.StatusCode, res.Header.Get("ETag"), hints)
+	}
+
+	if res, _ = get("/"); res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get(CacheStatusHeader), "hit") {
+		t.Errorf("Expected the response to be stored with its final status, got %d (%s)", res.StatusCode, res.Header.Get(CacheStatusHeader))
+	}
+}
+
+// TestUnsupportedInterfaces - ensures that a ResponseWriter without the optional interfaces fails gracefully
+func TestUnsupportedInterfaces(t *testing.T) {
+	hw := &headerWriter{ResponseWriter: plainWriter{httptest.NewRecorder()}, before: func(h http.Header, status int) {}}
+
+	if _, _, err := hw.Hijack(); err != http.ErrNotSupported {
+		t.Errorf("Expected http.ErrNotSupported from Hijack, got %v", err)
+	}
+
+	if err := hw.Push("/style.css", nil); err != http.ErrNotSupported {
+		t.Errorf("Expected http.ErrNotSupported from Push, got %v", err)
+	}
+
+	hw.Flush() // must not panic
+
+	n, err := hw.ReadFrom(bufio.NewReader(strings.NewReader("body")))
+	if err != nil || n != 4 {
+		t.Errorf("ReadFrom fallback failed: n=%d err=%v", n, err)
+	}
+}
+
+// plainWriter - A ResponseWriter that implements nothing but the bare interface
+type plainWriter struct {
+	rec *httptest.ResponseRecorder
+}
+
+func (pw plainWriter) Header() http.Header         { return pw.rec.Header() }
+func (pw plainWriter) Write(b []byte) (int, error) { return pw.rec.Write(b) }
+func (pw plainWriter) WriteHeader(status int)      { pw.rec.WriteHeader(status) }
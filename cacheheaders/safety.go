@@ -0,0 +1,130 @@
+package cacheheaders
+
+import (
+	"net/http"
+)
+
+// DowngradeAction - What to do with the cache directives of a response that matches a safety rule
+type DowngradeAction int
+
+const (
+	DowngradeNone    DowngradeAction = iota // keep the configured directives
+	DowngradePrivate                        // keep the response out of proxy caches, by replacing proxy-cacheable directives with "private"
+	DowngradeNoStore                        // keep the response out of every cache, with "no-store"
+)
+
+// String - Returns the directive the action downgrades to
+func (a DowngradeAction) String() string {
+	switch a {
+	case DowngradePrivate:
+		return "private"
+	case DowngradeNoStore:
+		return "no-store"
+	}
+
+	return "none"
+}
+
+// DowngradeReason - Why a response was downgraded, see SafetyRules
+type DowngradeReason string
+
+const (
+	ReasonUnsafeMethod  DowngradeReason = "unsafe-method"  // the request method is not safe (RFC 9110 section 9.2.1), eg. POST
+	ReasonAuthorization DowngradeReason = "authorization"  // the request has an Authorization header
+	ReasonSessionCookie DowngradeReason = "session-cookie" // the request has a session cookie
+	ReasonSetCookie     DowngradeReason = "set-cookie"     // the response sets a cookie
+)
+
+// Downgrade - Describes a response whose cache directives were downgraded by the safety rules
+type Downgrade struct {
+	Action  DowngradeAction   // the strongest action of the matched rules
+	Reasons []DowngradeReason // every matched rule, in the order they're listed on SafetyRules
+}
+
+// SafetyRules - Rules that keep personalised responses out of shared caches, whatever the CacheControl configuration says.
+// Each rule has an action: responses that match several rules get the strongest one.
+// Downgrades never make a response more cacheable than configured, and a Cache-Control header set by the handler is left alone
+// (without the configured targeted headers). Every configuration but no-store is downgraded to an unqualified "private".
+type SafetyRules struct {
+	UnsafeMethod  DowngradeAction // applies to requests with a method other than GET, HEAD, OPTIONS and TRACE
+	Authorization DowngradeAction // applies to requests with an Authorization header
+	SessionCookie DowngradeAction // applies to requests with one of the SessionCookies
+	SetCookie     DowngradeAction // applies to responses with a Set-Cookie header
+
+	// SessionCookies - The names of the cookies that identify a user session.
+	// A trailing * matches any suffix, eg. "wordpress_logged_in_*".
+	SessionCookies []string
+
+	// OnDowngrade - Optional. Called whenever a response is downgraded, eg. to log the reasons.
+	OnDowngrade func(r *http.Request, d Downgrade)
+}
+
+// DefaultSessionCookies - The session cookie names of common frameworks
+var DefaultSessionCookies = []string{"session", "sessionid", "SESSION", "PHPSESSID", "JSESSIONID", "ASP.NET_SessionId", "connect.sid", "wordpress_logged_in_*"}
+
+// DefaultSafetyRules - The safety rules used by a CacheControl with no Safety configured
+var DefaultSafetyRules = SafetyRules{
+	UnsafeMethod:   DowngradeNoStore,
+	Authorization:  DowngradePrivate,
+	SessionCookie:  DowngradePrivate,
+	SetCookie:      DowngradePrivate,
+	SessionCookies: DefaultSessionCookies,
+}
+
+// check - Evaluates the rules against a request and its response headers
+func (sr *SafetyRules) check(r *http.Request, h http.Header) Downgrade {
+	d := Downgrade{}
+	apply := func(action DowngradeAction, reason DowngradeReason) {
+		if action == DowngradeNone {
+			return
+		}
+
+		d.Reasons = append(d.Reasons, reason)
+		if action > d.Action {
+			d.Action = action
+		}
+	}
+
+	if !safeMethod(r.Method) {
+		apply(sr.UnsafeMethod, ReasonUnsafeMethod)
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		apply(sr.Authorization, ReasonAuthorization)
+	}
+
+	if sr.SessionCookie != DowngradeNone && sr.hasSessionCookie(r) {
+		apply(sr.SessionCookie, ReasonSessionCookie)
+	}
+
+	if len(h.Values("Set-Cookie")) > 0 {
+		apply(sr.SetCookie, ReasonSetCookie)
+	}
+
+	return d
+}
+
+// hasSessionCookie - Checks whether the request has one of the session cookies
+func (sr *SafetyRules) hasSessionCookie(r *http.Request) bool {
+	if r.Header.Get("Cookie") == "" {
+		return false
+	}
+
+	for _, c := range r.Cookies() {
+		if matchName(sr.SessionCookies, c.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// safeMethod - Checks whether a request method is safe (RFC 9110 section 9.2.1)
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
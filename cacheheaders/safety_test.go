@@ -0,0 +1,181 @@
+package cacheheaders
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSafetyRules(t *testing.T) {
+	var downgrades []Downgrade
+	rules := DefaultSafetyRules
+	rules.OnDowngrade = func(r *http.Request, d Downgrade) {
+		downgrades = append(downgrades, d)
+	}
+
+	surrogate := &CacheControl{}
+	surrogate.SetMaxAge(3600)
+
+	cc := &CacheControl{SurrogateControl: surrogate, Safety: &rules}
+	cc.SetMaxAge(60)
+	cc.SetSMaxAge(600)
+
+	tests := []struct {
+		name      string
+		method    string
+		header    http.Header
+		setCookie bool
+		expected  string
+		reasons   []DowngradeReason
+	}{
+		{"anonymous", "GET", nil, false, "max-age=60, s-maxage=600", nil},
+		{"analytics cookie", "GET", http.Header{"Cookie": {"_ga=GA1.2.3"}}, false, "max-age=60, s-maxage=600", nil},
+		{"authorization", "GET", http.Header{"Authorization": {"Bearer token"}}, false, "max-age=60, private", []DowngradeReason{ReasonAuthorization}},
+		{"session cookie", "GET", http.Header{"Cookie": {"_ga=GA1.2.3; PHPSESSID=abc"}}, false, "max-age=60, private", []DowngradeReason{ReasonSessionCookie}},
+		{"session cookie prefix", "GET", http.Header{"Cookie": {"wordpress_logged_in_123=abc"}}, false, "max-age=60, private", []DowngradeReason{ReasonSessionCookie}},
+		{"set-cookie", "GET", nil, true, "max-age=60, private", []DowngradeReason{ReasonSetCookie}},
+		{"unsafe method", "POST", nil, false, "no-store", []DowngradeReason{ReasonUnsafeMethod}},
+		{"unsafe method with authorization", "POST", http.Header{"Authorization": {"Basic dXNlcg=="}}, false, "no-store", []DowngradeReason{ReasonUnsafeMethod, ReasonAuthorization}},
+	}
+
+	for _, tt := range tests {
+		downgrades = nil
+		setCookie := tt.setCookie
+		handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if setCookie {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		request := httptest.NewRequest(tt.method, "/", nil)
+		for name, values := range tt.header {
+			request.Header[name] = values
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if got := recorder.Header().Get("Cache-Control"); got != tt.expected {
+			t.Errorf("%s: Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", tt.name, tt.expected, got)
+		}
+
+		// downgraded responses must not reach the targeted proxies either
+		gotSurrogate := recorder.Header().Get(SurrogateControlHeader)
+		if (gotSurrogate == "") != (tt.reasons != nil) {
+			t.Errorf("%s: unexpected Surrogate-Control header: %q", tt.name, gotSurrogate)
+		}
+
+		var gotReasons []DowngradeReason
+		if len(downgrades) > 0 {
+			gotReasons = downgrades[0].Reasons
+		}
+		if fmt.Sprint(gotReasons) != fmt.Sprint(tt.reasons) || len(downgrades) > 1 {
+			t.Errorf("%s: Downgrade reasons mismatch!\nExpected: %v\nGot     : %v\n", tt.name, tt.reasons, downgrades)
+		}
+	}
+}
+
+func TestSafetyRulesExceptions(t *testing.T) {
+	downgraded := false
+	rules := DefaultSafetyRules
+	rules.OnDowngrade = func(r *http.Request, d Downgrade) {
+		downgraded = true
+	}
+
+	get := func(cc *CacheControl, handlerCC string) string {
+		handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handlerCC != "" {
+				w.Header().Set("Cache-Control", handlerCC)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		request := httptest.NewRequest("POST", "/", nil)
+		request.Header.Set("Authorization", "Bearer token")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		return recorder.Header().Get("Cache-Control")
+	}
+
+	cc := &CacheControl{Safety: &rules}
+	cc.SetSMaxAge(600)
+
+	// a Cache-Control header set by the handler is left alone
+	if got := get(cc, "public, max-age=5"); got != "public, max-age=5" || downgraded {
+		t.Errorf("Expected the handler's Cache-Control header to be kept, got %q (downgraded: %v)", got, downgraded)
+	}
+
+	// ...and the configured targeted headers aren't added to it, since CDNs would obey them over the handler's directives
+	cdn := &CacheControl{}
+	cdn.SetMaxAge(600)
+	handler := (&CacheControl{CDNCacheControl: cdn, Safety: &rules}).SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+	}))
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer token")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if got := recorder.Header().Get(CDNCacheControlHeader); got != "" {
+		t.Errorf("Expected no CDN-Cache-Control header with the handler's Cache-Control header, got %q", got)
+	}
+
+	// a no-store configuration can't be downgraded any further
+	if got := get(&CacheControl{NoStore: true, MustUnderstand: true, Safety: &rules}, ""); got != "must-understand, no-store" || downgraded {
+		t.Errorf("Expected the no-store directives to be kept, got %q (downgraded: %v)", got, downgraded)
+	}
+
+	// empty rules disable the downgrades
+	cc.Update(func(cc *CacheControl) { cc.Safety = &SafetyRules{} })
+	if got := get(cc, ""); got != "s-maxage=600" {
+		t.Errorf("Expected no downgrade without safety rules, got %q", got)
+	}
+}
+
+func TestSafetyRulesNotProxyCacheable(t *testing.T) {
+	mustRevalidate := &CacheControl{MustRevalidate: true}
+
+	noCache := &CacheControl{}
+	noCache.SetNoCache()
+
+	tests := []struct {
+		name      string
+		cc        *CacheControl
+		header    http.Header
+		setCookie bool
+		expected  string
+	}{
+		// shared caches may store these, so they must still be downgraded
+		{"must-revalidate with authorization", mustRevalidate, http.Header{"Authorization": {"Bearer token"}}, false, "must-revalidate, private"},
+		{"no-cache with set-cookie", noCache, nil, true, "no-cache, private"},
+		{"no directives with a session cookie", &CacheControl{}, http.Header{"Cookie": {"session=abc"}}, false, "private"},
+	}
+
+	for _, tt := range tests {
+		setCookie := tt.setCookie
+		handler := tt.cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if setCookie {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		request := httptest.NewRequest("GET", "/", nil)
+		for name, values := range tt.header {
+			request.Header[name] = values
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if got := recorder.Header().Get("Cache-Control"); got != tt.expected {
+			t.Errorf("%s: Cache Control header mismatch!\nExpected: %v\nGot     : %v\n", tt.name, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package cacheheaders
+
+import (
+	"net/http"
+	"time"
+)
+
+// StatusPolicy - A middleware struct that picks a CacheControl configuration based on the response status code.
+// Useful for keeping error pages out of the proxy caches, eg. short negative caching for 404 and no-store for 5xx:
+//
+//	notFound := &cacheheaders.CacheControl{}
+//	notFound.SetSMaxAge(10)
+//
+//	policy := &cacheheaders.StatusPolicy{Default: ctrl}
+//	policy.Set(http.StatusNotFound, notFound)
+//	policy.SetRange(500, 599, &cacheheaders.CacheControl{NoStore: true})
+//	r.Use(policy.SendHeaders)
+type StatusPolicy struct {
+	Default *CacheControl // used for status codes without a matching rule. If nil, no header is sent for those.
+	rules   []statusRule
+}
+
+// statusRule - Maps a range of status codes (inclusive) to a CacheControl configuration
+type statusRule struct {
+	from, to int
+	cc       *CacheControl
+}
+
+// Set - Uses the specified CacheControl configuration for responses with the specified status code
+func (sp *StatusPolicy) Set(status int, cc *CacheControl) {
+	sp.SetRange(status, status, cc)
+}
+
+// SetRange - Uses the specified CacheControl configuration for responses with a status code from `from` to `to` (inclusive)
+// When several rules match a status code, the narrowest range wins. Among equally narrow ranges, the first one added wins.
+func (sp *StatusPolicy) SetRange(from, to int, cc *CacheControl) {
+	sp.rules = append(sp.rules, statusRule{from: from, to: to, cc: cc})
+}
+
+// For - Returns the CacheControl configuration for the specified status code
+func (sp *StatusPolicy) For(status int) *CacheControl {
+	var match *statusRule
+	for i, rule := range sp.rules {
+		if status < rule.from || status > rule.to {
+			continue
+		}
+
+		if match == nil || rule.to-rule.from < match.to-match.from {
+			match = &sp.rules[i]
+		}
+	}
+
+	if match == nil {
+		return sp.Default
+	}
+
+	return match.cc
+}
+
+// SendHeaders - A middleware function compatible with most routers.
+// Outputs cache headers according to the CacheControl configuration that matches the response status code.
+// A Cache-Control header set by the handler itself takes precedence over the policy.
+func (sp *StatusPolicy) SendHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{ResponseWriter: w, before: func(h http.Header, status int) {
+			if cc := sp.For(status); cc != nil {
+				cc.writeHeaders(r, h, status, time.Time{}) // the policy isn't known when the request arrives
+			}
+		}}
+
+		next.ServeHTTP(hw, r)
+		hw.finalize(http.StatusOK) // the handler might not have written anything
+	})
+}
@@ -0,0 +1,60 @@
+package cacheheaders
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusPolicy(t *testing.T) {
+	ok := &CacheControl{}
+	ok.SetMaxAge(60)
+	ok.SetSMaxAge(600)
+
+	notFound := &CacheControl{}
+	notFound.SetSMaxAge(10)
+
+	unavailable := &CacheControl{}
+	unavailable.SetSMaxAge(5)
+
+	policy := &StatusPolicy{Default: ok}
+	policy.Set(http.StatusNotFound, notFound)
+	policy.SetRange(500, 599, &CacheControl{NoStore: true})
+	policy.Set(http.StatusServiceUnavailable, unavailable) // narrower than 5xx, so this one wins
+
+	tests := []struct {
+		status   int
+		expected string
+	}{
+		{0, "max-age=60, s-maxage=600"}, // the handler doesn't call WriteHeader, so it's an implicit 200
+		{http.StatusOK, "max-age=60, s-maxage=600"},
+		{http.StatusNotFound, "s-maxage=10"},
+		{http.StatusInternalServerError, "no-store"},
+		{http.StatusBadGateway, "no-store"},
+		{http.StatusServiceUnavailable, "s-maxage=5"},
+	}
+
+	for _, tt := range tests {
+		status := tt.status
+		handler := policy.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status != 0 {
+				w.WriteHeader(status)
+			}
+			_, _ = w.Write([]byte("body"))
+		}))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+		if got := recorder.Header().Get("Cache-Control"); got != tt.expected {
+			t.Errorf("Cache Control header mismatch for status %d!\nExpected: %v\nGot     : %v\n", tt.status, tt.expected, got)
+		}
+	}
+
+	// without a default, unmatched status codes get no header
+	policy = &StatusPolicy{}
+	policy.Set(http.StatusNotFound, notFound)
+	if cc := policy.For(http.StatusOK); cc != nil {
+		t.Errorf("Expected no CacheControl for an unmatched status code, got %v", cc.cacheControlString())
+	}
+}
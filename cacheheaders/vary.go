@@ -0,0 +1,108 @@
+package cacheheaders
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Vary - The set of request headers that a response varies on, as sent in the "Vary" header.
+// Field names are normalized to their canonical form (eg. "accept-language" => "Accept-Language") and deduplicated,
+// so that values from several layers (middlewares, handlers) can be merged safely. The zero value is an empty set.
+type Vary struct {
+	fields   []string
+	seen     map[string]bool
+	wildcard bool
+}
+
+// ParseVary - Parses one or more Vary header values, eg. `ParseVary(h.Values("Vary")...)`
+func ParseVary(values ...string) *Vary {
+	v := &Vary{}
+	v.Add(values...)
+
+	return v
+}
+
+// Add - Adds field names (or comma-separated lists of them) to the set.
+// "*" means the response varies on more than request headers, which makes it impossible for caches to reuse it.
+func (v *Vary) Add(fields ...string) {
+	if v.seen == nil {
+		v.seen = map[string]bool{}
+	}
+
+	for _, list := range fields {
+		for _, field := range strings.Split(list, ",") {
+			field = strings.TrimSpace(field)
+			switch {
+			case field == "":
+				continue
+			case field == "*":
+				v.wildcard = true
+				continue
+			}
+
+			field = textproto.CanonicalMIMEHeaderKey(field)
+			if v.seen[field] {
+				continue
+			}
+
+			v.seen[field] = true
+			v.fields = append(v.fields, field)
+		}
+	}
+}
+
+// Merge - Adds the field names of another set
+func (v *Vary) Merge(other *Vary) {
+	if other == nil {
+		return
+	}
+
+	v.Add(other.fields...)
+	if other.wildcard {
+		v.Add("*")
+	}
+}
+
+// Fields - Returns the canonical field names, in the order they were added
+func (v *Vary) Fields() []string {
+	return v.fields
+}
+
+// Wildcard - Checks whether the set contains "*"
+func (v *Vary) Wildcard() bool {
+	return v.wildcard
+}
+
+// Empty - Checks whether the set has no field names at all
+func (v *Vary) Empty() bool {
+	return !v.wildcard && len(v.fields) == 0
+}
+
+// String - Returns the Vary header value
+func (v *Vary) String() string {
+	if v.wildcard {
+		return "*"
+	}
+
+	return strings.Join(v.fields, ", ")
+}
+
+// AddVary - Merges field names into the Vary header of a response, eg. from within a handler:
+// `cacheheaders.AddVary(w.Header(), "Accept-Language")`.
+// Unlike setting the header directly, this never overwrites the field names added by other layers.
+func AddVary(h http.Header, fields ...string) {
+	v := ParseVary(h.Values("Vary")...)
+	v.Add(fields...)
+	setVary(h, v)
+}
+
+// setVary - Replaces the Vary header(s) with a single, normalized one
+func setVary(h http.Header, v *Vary) {
+	if v.Empty() {
+		h.Del("Vary")
+		return
+	}
+
+	h.Set("Vary", v.String())
+}
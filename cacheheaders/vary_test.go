@@ -0,0 +1,79 @@
+package cacheheaders
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVary(t *testing.T) {
+	v := ParseVary("accept-encoding, ACCEPT-LANGUAGE", "Accept-Encoding")
+	v.Add("x-device-class", " ", "accept-language")
+
+	expected := "Accept-Encoding, Accept-Language, X-Device-Class"
+	if got := v.String(); got != expected {
+		t.Errorf("Vary mismatch!\nExpected: %v\nGot     : %v\n", expected, got)
+	}
+
+	v.Add("*")
+	if !v.Wildcard() || v.String() != "*" {
+		t.Errorf("Expected a wildcard Vary, got %v", v.String())
+	}
+
+	if !(&Vary{}).Empty() {
+		t.Errorf("The zero value of Vary should be empty")
+	}
+}
+
+func TestVaryMiddleware(t *testing.T) {
+	cc := &CacheControl{}
+	cc.SetMaxAge(60)
+	cc.SetSMaxAge(300)
+	cc.AddVary("accept-encoding")
+
+	// several layers: the middleware, another middleware setting the header directly, and the handler
+	handler := cc.SendHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding, x-device-class")
+		AddVary(w.Header(), "Accept-Language")
+
+		if r.URL.Path == "/wildcard" {
+			AddVary(w.Header(), "*")
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path         string
+		vary         string
+		cacheControl string
+	}{
+		{"/", "Accept-Encoding, X-Device-Class, Accept-Language", "max-age=60, s-maxage=300"},
+		{"/wildcard", "*", "max-age=60, private"}, // proxy-cacheable directives are refused with Vary: *
+	}
+
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", tt.path, nil))
+
+		if got := recorder.Header().Values("Vary"); len(got) != 1 || got[0] != tt.vary {
+			t.Errorf("%s: Vary mismatch!\nExpected: %v\nGot     : %v\n", tt.path, tt.vary, got)
+		}
+
+		if got := recorder.Header().Get("Cache-Control"); got != tt.cacheControl {
+			t.Errorf("%s: Cache-Control mismatch!\nExpected: %v\nGot     : %v\n", tt.path, tt.cacheControl, got)
+		}
+	}
+
+	// a wildcard Vary on the configuration itself is caught by Validate
+	cc.AddVary("*")
+	if err := cc.Validate(); err == nil {
+		t.Errorf("Expected a validation error for Vary: * with proxy-cacheable directives")
+	}
+
+	private := &CacheControl{Private: true}
+	private.AddVary("*")
+	if err := private.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %s", err.Error())
+	}
+}
@@ -1,26 +1,25 @@
 // Package concealog : can be used to remove credentials from request log data
 package concealog
 
-import (
-	"regexp"
-)
-
-// AuthReplacer - Replaces the `Authorization` header in request dumps
+// AuthReplacer - Replaces the `Authorization` and `Proxy-Authorization` headers in request dumps.
+// Kept for compatibility: use a Redactor to mask other headers as well.
 type AuthReplacer struct {
-	cReg *regexp.Regexp
-	cRep string
+	r *Redactor
 }
 
 // NewAuthReplacer - returns an initialized AuthReplacer
 func NewAuthReplacer() (ar *AuthReplacer, err error) {
 	ar = &AuthReplacer{}
-	ar.cReg, err = regexp.Compile(`Authorization: (\w+) [\w-]+`)
-	ar.cRep = `Authorization: $1 *********`
+	// the original pattern wasn't anchored, so it matched the end of "Proxy-Authorization" too
+	ar.r, err = NewRedactor(HeaderRule{Name: "Authorization", Rule: MaskKeepScheme}, HeaderRule{Name: "Proxy-Authorization", Rule: MaskKeepScheme})
+	if err == nil {
+		ar.r.URLs = nil // only the authorization headers, as it always was
+	}
 	return
 }
 
 // ReplaceString - takes a request body as input,
 // and replaces any authorization headers with stars
 func (ar *AuthReplacer) ReplaceString(body string) string {
-	return ar.cReg.ReplaceAllString(body, ar.cRep)
+	return ar.r.ReplaceString(body)
 }
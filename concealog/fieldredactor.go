@@ -0,0 +1,536 @@
+package concealog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// errInvalidJSON - Stops the JSON redaction at the first syntax error, so that the rest of the body falls back to the string-level rules
+var errInvalidJSON = errors.New("concealog: invalid JSON")
+
+// errInvalidMaskedJSON - A syntax error in the value of a masked field. What's left of it can't be told from the rest of the body,
+// so the rest of the body is dropped, rather than sent to the string-level rules that wouldn't know it's secret.
+var errInvalidMaskedJSON = errors.New("concealog: invalid JSON in a masked value")
+
+// jsonNumber - Matches a JSON number
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// FieldRedactor - Masks the fields of JSON and form bodies by path, eg. "$.user.password", "card.number" or "users[*].token".
+// A "*" segment matches any field, or any array element. Form fields match with dots or brackets: "card.number" or "card[number]".
+// Bodies are streamed, so that large ones aren't loaded into memory.
+type FieldRedactor struct {
+	// Fallback - optional. The string-level rules for bodies that are neither JSON nor forms,
+	// and for what's left of a JSON body after a syntax error. Defaults to a Redactor with the DefaultHeaderRules.
+	Fallback *Redactor
+
+	paths [][]string
+}
+
+// NewFieldRedactor - returns a FieldRedactor for the specified field paths
+func NewFieldRedactor(paths ...string) (*FieldRedactor, error) {
+	f := &FieldRedactor{}
+	for _, path := range paths {
+		segments, err := parseFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		f.paths = append(f.paths, segments)
+	}
+
+	return f, nil
+}
+
+// parseFieldPath - Splits a field path into its segments: "$.users[*].token" => users, *, token
+func parseFieldPath(path string) ([]string, error) {
+	p := strings.NewReplacer("[", ".", "]", "", `'`, "", `"`, "").Replace(path)
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+
+	segments := strings.Split(p, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("concealog: invalid field path %q", path)
+		}
+	}
+
+	return segments, nil
+}
+
+// Redact - Copies the body to dst with its fields masked, according to its Content-Type:
+// JSON (application/json, or any +json type), forms (application/x-www-form-urlencoded), or anything else with the Fallback rules
+func (f *FieldRedactor) Redact(dst io.Writer, src io.Reader, contentType string) error {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return f.RedactJSON(dst, src)
+	case mediaType == "application/x-www-form-urlencoded":
+		return f.RedactForm(dst, src)
+	}
+
+	w := bufio.NewWriter(dst)
+	if err := f.replaceLines(w, bufio.NewReader(src)); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// RedactJSON - Copies a JSON body (or a stream of JSON values, eg. NDJSON) to dst, with its fields masked as "*********".
+// The formatting is preserved. If the body turns out not to be valid JSON, the rest of it is masked with the Fallback rules,
+// unless the syntax error is in the value of a masked field: the rest of the body is then dropped.
+func (f *FieldRedactor) RedactJSON(dst io.Writer, src io.Reader) error {
+	w := bufio.NewWriter(dst)
+	s := &jsonScanner{f: f, r: bufio.NewReader(src), w: w, discard: bufio.NewWriter(ioutil.Discard)}
+	s.out = w
+
+	err := s.values()
+	switch err {
+	case errInvalidJSON:
+		err = f.replaceLines(w, s.r)
+	case errInvalidMaskedJSON:
+		_, err = io.Copy(ioutil.Discard, s.r)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// RedactForm - Copies a form body to dst, with the values of its fields masked as "*********"
+func (f *FieldRedactor) RedactForm(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	discard := bufio.NewWriter(ioutil.Discard)
+
+	for {
+		name, sep, err := readFormName(r)
+		if err != nil {
+			return err
+		}
+
+		w.WriteString(name)
+		if sep == '=' {
+			w.WriteByte('=')
+
+			out := w
+			if f.matches(formFieldPath(name)) {
+				w.WriteString(Mask)
+				out = discard
+			}
+
+			if sep, err = copyUntil(out, r, '&'); err != nil {
+				return err
+			}
+		}
+
+		if sep == 0 {
+			return w.Flush()
+		}
+
+		w.WriteByte('&')
+	}
+}
+
+// readFormName - Reads the name of a form field, up to the "=" or "&" that follows it. The separator is 0 at the end of the body.
+func readFormName(r *bufio.Reader) (string, byte, error) {
+	var name strings.Builder
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return name.String(), 0, nil
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		if c == '=' || c == '&' {
+			return name.String(), c, nil
+		}
+		name.WriteByte(c)
+	}
+}
+
+// copyUntil - Streams the reader to the writer, up to the delimiter, which is consumed but not written.
+// Returns the delimiter, or 0 at the end of the reader.
+func copyUntil(w *bufio.Writer, r *bufio.Reader, delim byte) (byte, error) {
+	for {
+		chunk, err := r.ReadSlice(delim)
+		switch err {
+		case nil:
+			w.Write(chunk[:len(chunk)-1])
+			return delim, nil
+		case bufio.ErrBufferFull:
+			w.Write(chunk)
+		case io.EOF:
+			w.Write(chunk)
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+}
+
+// formFieldPath - Splits a form field name into its segments: "card[number]" or "card.number" => card, number
+func formFieldPath(name string) []string {
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	bracket := strings.IndexByte(name, '[')
+	if bracket < 0 {
+		return strings.Split(name, ".")
+	}
+
+	segments := []string{name[:bracket]}
+	for _, segment := range strings.Split(name[bracket+1:], "[") {
+		segments = append(segments, strings.TrimSuffix(segment, "]"))
+	}
+
+	return segments
+}
+
+// matches - Reports whether the field at the path is masked
+func (f *FieldRedactor) matches(path []string) bool {
+	for _, p := range f.paths {
+		if len(p) != len(path) {
+			continue
+		}
+
+		matched := true
+		for i := range p {
+			if p[i] != "*" && p[i] != path[i] {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replaceLines - Streams the reader to the writer line by line, masked with the Fallback rules (which only ever match within a line)
+func (f *FieldRedactor) replaceLines(w *bufio.Writer, r *bufio.Reader) error {
+	fallback := f.Fallback
+	if fallback == nil {
+		fallback = defaultRedactor
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		w.WriteString(fallback.ReplaceString(line))
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// jsonScanner - Copies JSON values from r to out, byte for byte, except for the values of masked fields
+type jsonScanner struct {
+	f       *FieldRedactor
+	r       *bufio.Reader
+	w       *bufio.Writer // the destination
+	discard *bufio.Writer // where masked values go
+	out     *bufio.Writer // w, or discard while a masked value is skipped
+	path    []string      // the path of the current value
+}
+
+// values - Copies a stream of JSON values, up to the end of the input
+func (s *jsonScanner) values() error {
+	for {
+		if err := s.space(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.value(false); err != nil {
+			return err
+		}
+	}
+}
+
+// value - Copies a JSON value, or writes the mask instead
+func (s *jsonScanner) value(mask bool) error {
+	c, err := s.peek()
+	if err != nil {
+		return err
+	}
+
+	if mask {
+		s.out.WriteString(`"` + Mask + `"`)
+
+		out := s.out
+		s.out = s.discard
+		defer func() { s.out = out }()
+	}
+
+	switch c {
+	case '{':
+		err = s.object()
+	case '[':
+		err = s.array()
+	case '"':
+		_, err = s.str(false)
+	default:
+		err = s.literal()
+	}
+
+	if mask && err == errInvalidJSON {
+		return errInvalidMaskedJSON
+	}
+
+	return err
+}
+
+// object - Copies a JSON object
+func (s *jsonScanner) object() error {
+	s.copyByte()
+	if err := s.eof(s.space()); err != nil {
+		return err
+	}
+
+	if c, err := s.peek(); err != nil {
+		return err
+	} else if c == '}' {
+		s.copyByte()
+		return nil
+	}
+
+	for {
+		if c, err := s.peek(); err != nil {
+			return err
+		} else if c != '"' {
+			return errInvalidJSON
+		}
+
+		key, err := s.str(true)
+		if err != nil {
+			return err
+		}
+
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+
+		s.path = append(s.path, key)
+		err = s.member()
+		s.path = s.path[:len(s.path)-1]
+		if err != nil {
+			return err
+		}
+
+		if last, err := s.next('}'); last || err != nil {
+			return err
+		}
+	}
+}
+
+// array - Copies a JSON array
+func (s *jsonScanner) array() error {
+	s.copyByte()
+	if err := s.eof(s.space()); err != nil {
+		return err
+	}
+
+	if c, err := s.peek(); err != nil {
+		return err
+	} else if c == ']' {
+		s.copyByte()
+		return nil
+	}
+
+	for i := 0; ; i++ {
+		s.path = append(s.path, strconv.Itoa(i))
+		err := s.member()
+		s.path = s.path[:len(s.path)-1]
+		if err != nil {
+			return err
+		}
+
+		if last, err := s.next(']'); last || err != nil {
+			return err
+		}
+	}
+}
+
+// member - Copies the value of an object member or array element, masked if its path matches
+func (s *jsonScanner) member() error {
+	if err := s.eof(s.space()); err != nil {
+		return err
+	}
+
+	if err := s.value(s.f.matches(s.path)); err != nil {
+		return err
+	}
+
+	return s.eof(s.space())
+}
+
+// next - Copies the separator after an object member or array element. Returns true at the end of the object or array.
+func (s *jsonScanner) next(end byte) (bool, error) {
+	c, err := s.peek()
+	if err != nil {
+		return false, err
+	}
+
+	switch c {
+	case end:
+		s.copyByte()
+		return true, nil
+	case ',':
+		s.copyByte()
+		return false, s.eof(s.space())
+	}
+
+	return false, errInvalidJSON
+}
+
+// expect - Copies the expected byte, surrounded by whitespace
+func (s *jsonScanner) expect(expected byte) error {
+	if err := s.eof(s.space()); err != nil {
+		return err
+	}
+
+	if c, err := s.peek(); err != nil {
+		return err
+	} else if c != expected {
+		return errInvalidJSON
+	}
+
+	s.copyByte()
+	return nil
+}
+
+// str - Copies a JSON string. If decode is true, it's also returned decoded (for object keys).
+func (s *jsonScanner) str(decode bool) (string, error) {
+	var raw []byte
+	escaped := false
+	for i := 0; ; i++ {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return "", s.eof(err)
+		}
+
+		s.out.WriteByte(c)
+		if decode {
+			raw = append(raw, c)
+		}
+
+		switch {
+		case c < ' ':
+			return "", errInvalidJSON
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"' && i > 0:
+			if !decode {
+				return "", nil
+			}
+
+			var decoded string
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				return "", errInvalidJSON
+			}
+			return decoded, nil
+		}
+	}
+}
+
+// literal - Copies a JSON number, true, false or null
+func (s *jsonScanner) literal() error {
+	// peek the whole literal before consuming it, so that an invalid one is left for the fallback rules
+	n := 0
+	for {
+		b, err := s.r.Peek(n + 1)
+		if len(b) <= n {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+
+		c := b[n]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' || c == 'E') {
+			break
+		}
+
+		if n++; n >= s.r.Size() {
+			return errInvalidJSON
+		}
+	}
+
+	literal, _ := s.r.Peek(n)
+	switch string(literal) {
+	case "true", "false", "null":
+	default:
+		if !jsonNumber.Match(literal) {
+			return errInvalidJSON
+		}
+	}
+
+	s.out.Write(literal)
+	_, err := s.r.Discard(n)
+	return err
+}
+
+// space - Copies whitespace. Returns io.EOF at the end of the input.
+func (s *jsonScanner) space() error {
+	for {
+		b, err := s.r.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			s.copyByte()
+		default:
+			return nil
+		}
+	}
+}
+
+// peek - Returns the next byte without consuming it. The end of the input is a syntax error, since a value is expected.
+func (s *jsonScanner) peek() (byte, error) {
+	b, err := s.r.Peek(1)
+	if err != nil {
+		return 0, s.eof(err)
+	}
+
+	return b[0], nil
+}
+
+// copyByte - Copies the next byte, which has been peeked
+func (s *jsonScanner) copyByte() {
+	c, _ := s.r.ReadByte()
+	s.out.WriteByte(c)
+}
+
+// eof - Turns an unexpected end of the input into a syntax error, eg. for truncated bodies. Other errors are returned as they are.
+func (s *jsonScanner) eof(err error) error {
+	if err == io.EOF {
+		return errInvalidJSON
+	}
+
+	return err
+}
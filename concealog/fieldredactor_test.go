@@ -0,0 +1,175 @@
+package concealog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRedactJSON - ensures that JSON fields are masked by path, with the rest of the body left as it was
+func TestRedactJSON(t *testing.T) {
+	f, err := NewFieldRedactor("$.user.password", "card.number", "card.cvc", "tokens[*].value", "$.session")
+	if err != nil {
+		t.Errorf("Failed to create FieldRedactor: %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"nested fields, formatting preserved",
+			"{\n  \"user\": {\"name\": \"lion\", \"password\": \"k\\\"ing\"},\n  \"card\" : {\"number\": 4111111111111111, \"cvc\": \"123\", \"exp\": [12, 2030]}\n}",
+			"{\n  \"user\": {\"name\": \"lion\", \"password\": \"*********\"},\n  \"card\" : {\"number\": \"*********\", \"cvc\": \"*********\", \"exp\": [12, 2030]}\n}",
+		},
+		{
+			"wildcard array elements, and objects masked as a whole",
+			`{"tokens":[{"value":"a","type":"x"},{"value":{"nested":true}}],"session":{"id":"abc","data":[1,2]},"ok":null}`,
+			`{"tokens":[{"value":"*********","type":"x"},{"value":"*********"}],"session":"*********","ok":null}`,
+		},
+		{
+			"unmatched paths",
+			`[{"user":{"password":"top-level array"}},{"password":"not under user"}]`,
+			`[{"user":{"password":"top-level array"}},{"password":"not under user"}]`,
+		},
+		{
+			"a stream of values",
+			"{\"session\":\"a\"}\n{\"session\":\"b\"}\n",
+			"{\"session\":\"*********\"}\n{\"session\":\"*********\"}\n",
+		},
+		{
+			"invalid JSON falls back to the string rules",
+			"Authorization: Bearer abc.def\n{\"session\":\"a\"}",
+			"Authorization: Bearer *********\n{\"session\":\"a\"}",
+		},
+		{
+			"the rest of a broken body falls back to the string rules",
+			"{\"session\":\"a\",\nGET /?access_token=abc HTTP/1.1",
+			"{\"session\":\"*********\",\nGET /?access_token=********* HTTP/1.1",
+		},
+		{
+			"a truncated body",
+			"{\"session\":\"a\",\"user\":{\"password\":\"ki",
+			"{\"session\":\"*********\",\"user\":{\"password\":\"*********\"",
+		},
+		{
+			"an invalid literal",
+			"{\"session\": \"a\", \"x\": nope}\nX-Api-Key: secret",
+			"{\"session\": \"*********\", \"x\": nope}\nX-Api-Key: *********",
+		},
+		{
+			"an invalid number in a masked value drops the rest of the body",
+			"{\"user\": {\"password\": 0123456}}\n{\"ok\": true}",
+			"{\"user\": {\"password\": \"*********\"",
+		},
+		{
+			"a raw tab in a masked string drops the rest of the body",
+			"{\"user\": {\"password\": \"1\t2secret\"}}",
+			"{\"user\": {\"password\": \"*********\"",
+		},
+		{
+			"a syntax error deep in a masked object drops the rest of the body",
+			"{\"session\": {\"id\": nope,\n\"secret\": \"abc\"}}",
+			"{\"session\": \"*********\"",
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := f.RedactJSON(&out, strings.NewReader(tt.input)); err != nil {
+			t.Errorf("%s: Unexpected error: %s", tt.name, err.Error())
+			continue
+		}
+
+		if out.String() != tt.expected {
+			t.Errorf("%s: Unexpected output!\nExpected:\n%s\n\nGot:\n%s\n\n", tt.name, tt.expected, out.String())
+		}
+	}
+}
+
+// TestRedactForm - ensures that form fields are masked by path, with dots or brackets
+func TestRedactForm(t *testing.T) {
+	f, err := NewFieldRedactor("password", "card.number", "users.*.token")
+	if err != nil {
+		t.Errorf("Failed to create FieldRedactor: %s", err.Error())
+		return
+	}
+
+	input := "user=lion&password=k%26ing&card%5Bnumber%5D=4111&card.exp=12&users[0][token]=a&users[1][name]=b&remember&password="
+	expected := "user=lion&password=*********&card%5Bnumber%5D=*********&card.exp=12&users[0][token]=*********&users[1][name]=b&remember&password=*********"
+
+	var out bytes.Buffer
+	if err := f.RedactForm(&out, strings.NewReader(input)); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+		return
+	}
+
+	if out.String() != expected {
+		t.Errorf("Unexpected output!\nExpected:\n%s\n\nGot:\n%s\n\n", expected, out.String())
+	}
+
+	// values larger than the read buffer are streamed
+	long := strings.Repeat("x", 100000)
+	out.Reset()
+	if err := f.RedactForm(&out, strings.NewReader("a="+long+"&password="+long+"&b=c")); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+		return
+	}
+
+	if expected := "a=" + long + "&password=*********&b=c"; out.String() != expected {
+		t.Errorf("Unexpected output for long values, got %d bytes", out.Len())
+	}
+}
+
+// TestRedactContentType - ensures that bodies are redacted according to their Content-Type
+func TestRedactContentType(t *testing.T) {
+	f, _ := NewFieldRedactor("password")
+
+	tests := map[string][]string{
+		"application/json; charset=utf-8":   {`{"password":"a"}`, `{"password":"*********"}`},
+		"application/vnd.api+json":          {`{"password":"a"}`, `{"password":"*********"}`},
+		"application/x-www-form-urlencoded": {"password=a", "password=*********"},
+		"text/plain":                        {"password=a\nCookie: a=b", "password=a\nCookie: *********"},
+	}
+
+	for contentType, tt := range tests {
+		var out bytes.Buffer
+		if err := f.Redact(&out, strings.NewReader(tt[0]), contentType); err != nil {
+			t.Errorf("%s: Unexpected error: %s", contentType, err.Error())
+			continue
+		}
+
+		if out.String() != tt[1] {
+			t.Errorf("%s: Unexpected output!\nExpected:\n%s\n\nGot:\n%s\n\n", contentType, tt[1], out.String())
+		}
+	}
+}
+
+// TestRedactRequestFields - ensures that a Redactor masks the fields of the bodies it copies
+func TestRedactRequestFields(t *testing.T) {
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"user":"lion","password":"king"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	r, _ := NewRedactor(DefaultHeaderRules...)
+	r.Bodies = true
+	r.Fields, _ = NewFieldRedactor("password")
+
+	redacted := r.RedactRequest(req)
+	expected := `{"user":"lion","password":"*********"}`
+	if got, _ := ioutil.ReadAll(redacted.Body); string(got) != expected || redacted.ContentLength != int64(len(expected)) {
+		t.Errorf("Body mismatch!\nExpected: %v\nGot     : %v\n", expected, string(got))
+	}
+}
+
+// TestFieldPaths - ensures that invalid field paths are rejected
+func TestFieldPaths(t *testing.T) {
+	for _, path := range []string{"", "$", "user..password", "$.user.", "users[]"} {
+		if _, err := NewFieldRedactor(path); err == nil {
+			t.Errorf("Expected an error for the path %q", path)
+		}
+	}
+}
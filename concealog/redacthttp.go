@@ -0,0 +1,210 @@
+package concealog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultRedactor - The Redactor used by RedactRequest and RedactResponse
+var defaultRedactor, _ = NewRedactor(DefaultHeaderRules...)
+
+// schemeValue - Splits a header value into its authentication scheme and credentials
+var schemeValue = regexp.MustCompile(`^(` + schemeToken + `) +(\S.*)$`)
+
+// RedactRequest - Returns a deep copy of the request, with the DefaultHeaderRules headers, cookies, URL userinfo
+// and DefaultQueryParams masked, and without a body. See Redactor.RedactRequest.
+func RedactRequest(req *http.Request) *http.Request {
+	return defaultRedactor.RedactRequest(req)
+}
+
+// RedactResponse - Returns a deep copy of the response, with the DefaultHeaderRules headers and cookies masked,
+// and without a body. See Redactor.RedactResponse.
+func RedactResponse(res *http.Response) *http.Response {
+	return defaultRedactor.RedactResponse(res)
+}
+
+// RedactRequest - Returns a deep copy of the request, eg. to log with httputil.DumpRequest, with the sensitive
+// headers, cookie values, URL userinfo and query / form parameters masked.
+// The original request is left untouched, and can still be sent. If the Redactor copies bodies, and the request
+// can't provide a fresh copy of its body through GetBody, up to MaxBodySize of its body is read ahead,
+// and the body is replaced by one that reads the same content.
+func (r *Redactor) RedactRequest(req *http.Request) *http.Request {
+	redacted := req.Clone(req.Context())
+	r.redactHeader(redacted.Header)
+	r.redactHeader(redacted.Trailer)
+
+	if r.URLs != nil {
+		redacted.URL = r.URLs.ScrubURL(redacted.URL)
+		redacted.RequestURI = r.URLs.scrubRawURL(redacted.RequestURI)
+
+		r.URLs.scrubValues(redacted.Form)
+		r.URLs.scrubValues(redacted.PostForm)
+		if redacted.MultipartForm != nil {
+			r.URLs.scrubValues(redacted.MultipartForm.Value)
+		}
+	}
+
+	redacted.GetBody = nil
+	redacted.Body, redacted.ContentLength = http.NoBody, 0
+	if !r.Bodies || req.Body == nil || req.Body == http.NoBody {
+		return redacted
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		if rc, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(io.LimitReader(rc, r.maxBodySize()+1))
+			rc.Close()
+		}
+	} else {
+		req.Body, body = readBody(req.Body, r.maxBodySize())
+	}
+
+	redacted.Body, redacted.ContentLength = r.redactBody(body, req.Header.Get("Content-Type"))
+	return redacted
+}
+
+// RedactResponse - Returns a deep copy of the response, eg. to log with httputil.DumpResponse, with the sensitive
+// headers and cookie values masked. Its Request, if any, is redacted like RedactRequest does.
+// If the Redactor copies bodies, up to MaxBodySize of the original response's body is read ahead,
+// and the body is replaced by one that reads the same content.
+func (r *Redactor) RedactResponse(res *http.Response) *http.Response {
+	redacted := new(http.Response)
+	*redacted = *res
+
+	redacted.Header = res.Header.Clone()
+	redacted.Trailer = res.Trailer.Clone()
+	r.redactHeader(redacted.Header)
+	r.redactHeader(redacted.Trailer)
+
+	if res.Request != nil {
+		redacted.Request = r.RedactRequest(res.Request)
+	}
+
+	redacted.Body, redacted.ContentLength = http.NoBody, 0
+	if !r.Bodies || res.Body == nil || res.Body == http.NoBody {
+		redacted.Header.Del("Content-Length")
+		return redacted
+	}
+
+	var body []byte
+	res.Body, body = readBody(res.Body, r.maxBodySize())
+	redacted.Body, redacted.ContentLength = r.redactBody(body, res.Header.Get("Content-Type"))
+	if redacted.Header.Get("Content-Length") != "" {
+		redacted.Header.Set("Content-Length", strconv.FormatInt(redacted.ContentLength, 10))
+	}
+
+	return redacted
+}
+
+// readBody - Reads up to one byte more than the limit of a body, and returns a replacement that reads the same content.
+// If reading fails, the replacement returns the same error after the content that was read.
+func readBody(body io.ReadCloser, limit int64) (io.ReadCloser, []byte) {
+	content, _ := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(content), body), body}, content
+}
+
+// redactBody - Returns the masked body of a copy, and its length. Bodies larger than MaxBodySize are replaced by a note.
+func (r *Redactor) redactBody(body []byte, contentType string) (io.ReadCloser, int64) {
+	if limit := r.maxBodySize(); int64(len(body)) > limit {
+		note := fmt.Sprintf("[concealog: body larger than %d bytes not copied]", limit)
+		return ioutil.NopCloser(strings.NewReader(note)), int64(len(note))
+	}
+
+	if r.Fields == nil {
+		masked := string(body)
+		if r.URLs != nil && isForm(contentType) {
+			masked = r.URLs.scrubQuery(masked) // forms are encoded like query strings, with the same sensitive parameters
+		}
+
+		masked = r.ReplaceString(masked)
+		return ioutil.NopCloser(strings.NewReader(masked)), int64(len(masked))
+	}
+
+	// bodies that aren't JSON or forms are masked with the rules of this Redactor, unless the FieldRedactor has its own
+	fields := *r.Fields
+	if fields.Fallback == nil {
+		fields.Fallback = r
+	}
+
+	var masked bytes.Buffer
+	_ = fields.Redact(&masked, bytes.NewReader(body), contentType) // reading from and writing to memory can't fail
+	return ioutil.NopCloser(&masked), int64(masked.Len())
+}
+
+// maxBodySize - Returns the configured body size limit, or the default
+func (r *Redactor) maxBodySize() int64 {
+	if r.MaxBodySize > 0 {
+		return r.MaxBodySize
+	}
+
+	return 64 << 10
+}
+
+// isForm - Reports whether a Content-Type is application/x-www-form-urlencoded
+func isForm(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/x-www-form-urlencoded"
+}
+
+// redactHeader - Masks the values of the headers the Redactor was configured with
+func (r *Redactor) redactHeader(h http.Header) {
+	for name, values := range h {
+		for _, rule := range r.rules {
+			if !strings.EqualFold(name, rule.Name) {
+				continue
+			}
+
+			for i, value := range values {
+				values[i] = maskValue(rule, value)
+			}
+		}
+	}
+}
+
+// maskValue - Masks a header value according to its rule. Cookies keep their names.
+func maskValue(rule HeaderRule, value string) string {
+	switch {
+	case value == "":
+		return value
+	case strings.EqualFold(rule.Name, "Cookie"):
+		return maskCookies(value, false)
+	case strings.EqualFold(rule.Name, "Set-Cookie"):
+		return maskCookies(value, true)
+	case rule.Rule == MaskKeepScheme:
+		if m := schemeValue.FindStringSubmatch(value); m != nil {
+			return m[1] + " " + maskCredentials(m[1], m[2])
+		}
+	}
+
+	return Mask
+}
+
+// maskCookies - Masks cookie values, keeping their names: "session=*********; theme=*********".
+// Set-Cookie headers keep their attributes: "session=*********; Path=/; HttpOnly"
+func maskCookies(value string, set bool) string {
+	cookies := strings.Split(value, ";")
+	for i, cookie := range cookies {
+		if set && i > 0 {
+			break
+		}
+
+		if eq := strings.IndexByte(cookie, '='); eq >= 0 {
+			cookies[i] = cookie[:eq+1] + Mask
+		} else if strings.TrimSpace(cookie) != "" {
+			cookies[i] = Mask
+		}
+	}
+
+	return strings.Join(cookies, ";")
+}
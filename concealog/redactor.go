@@ -0,0 +1,145 @@
+package concealog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Mask - The replacement for redacted values
+const Mask = "*********"
+
+// MaskRule - How the value of a header is masked
+type MaskRule int
+
+const (
+	MaskAll        MaskRule = iota // the whole value is masked: "Cookie: *********"
+	MaskKeepScheme                 // the authentication scheme is kept, the credentials are masked: "Authorization: Bearer *********"
+)
+
+// schemeToken - Matches an authentication scheme, eg. "Bearer" or "AWS4-HMAC-SHA256"
+const schemeToken = "[\\w!#$%&'*+.^`|~-]+"
+
+// digestSecrets - The Digest auth parameters that are masked. The others (username, realm, uri...) are kept, as they help debugging.
+var digestSecrets = regexp.MustCompile(`(?i)\b((?:response|nonce)=)(?:"[^"]*"|[^,\s]*)`)
+
+// HeaderRule - A header to redact, and how. Header names are case-insensitive.
+type HeaderRule struct {
+	Name string
+	Rule MaskRule
+}
+
+// DefaultHeaderRules - The headers that commonly carry credentials
+var DefaultHeaderRules = []HeaderRule{
+	{Name: "Authorization", Rule: MaskKeepScheme},
+	{Name: "Proxy-Authorization", Rule: MaskKeepScheme},
+	{Name: "Cookie", Rule: MaskAll},
+	{Name: "Set-Cookie", Rule: MaskAll},
+	{Name: "X-Api-Key", Rule: MaskAll},
+}
+
+// Redactor - Masks the values of credential-carrying headers in request / response dumps,
+// or in copies of the requests and responses themselves, see RedactRequest.
+type Redactor struct {
+	URLs   *URLScrubber   // optional. Masks the credentials of the URLs in dumps, and of the URL and form of requests. Set by NewRedactor.
+	Bodies bool           // if true, RedactRequest / RedactResponse copy the body, masked with ReplaceString. Otherwise the copies have no body.
+	Fields *FieldRedactor // optional. Masks the fields of JSON and form bodies copied by RedactRequest / RedactResponse, instead of ReplaceString.
+
+	// MaxBodySize - optional. The largest body that RedactRequest / RedactResponse copy: at most this much of the original body is read
+	// ahead and held in memory, along with its masked copy. Larger bodies are replaced by a note in the copies. Defaults to 64 KB.
+	MaxBodySize int64
+
+	rules   []HeaderRule
+	regexes []*regexp.Regexp
+}
+
+// NewRedactor - returns a Redactor for the specified header rules, eg.
+// `concealog.NewRedactor(append(concealog.DefaultHeaderRules, concealog.HeaderRule{Name: "X-Auth-Token"})...)`
+func NewRedactor(rules ...HeaderRule) (*Redactor, error) {
+	r := &Redactor{URLs: &URLScrubber{}}
+	for _, rule := range rules {
+		if err := r.add(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// add - Compiles the regex of a header rule
+func (r *Redactor) add(rule HeaderRule) error {
+	if rule.Name == "" || strings.ContainsAny(rule.Name, " \t\r\n:") {
+		return fmt.Errorf("concealog: invalid header name %q", rule.Name)
+	}
+
+	// the header name must not be part of a longer name, eg. "X-Authorization"
+	prefix := `(?mi)(^|[^\w-])(` + regexp.QuoteMeta(rule.Name) + `:[ \t]*)`
+
+	// credentials are masked up to the end of the line, whatever their characters: base64 (+ / =), JWTs (.), quoted parameters...
+	var expr string
+	switch rule.Rule {
+	case MaskAll:
+		expr = prefix + `()([^\s][^\r\n]*)`
+	case MaskKeepScheme:
+		expr = prefix + `(` + schemeToken + ` +)?([^\s][^\r\n]*)`
+	default:
+		return fmt.Errorf("concealog: unknown mask rule %d for %s", rule.Rule, rule.Name)
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+
+	r.rules = append(r.rules, rule)
+	r.regexes = append(r.regexes, re)
+	return nil
+}
+
+// ReplaceString - takes a request / response dump as input,
+// and masks the values of the headers the Redactor was configured with, and the credentials of URLs
+func (r *Redactor) ReplaceString(body string) string {
+	for _, re := range r.regexes {
+		body = replaceCredentials(re, body)
+	}
+
+	if r.URLs != nil {
+		body = r.URLs.ReplaceString(body)
+	}
+
+	return body
+}
+
+// replaceCredentials - Masks the credentials matched by a header rule regex,
+// whose groups are the preceding character, the header name, the scheme (if kept) and the credentials
+func replaceCredentials(re *regexp.Regexp, body string) string {
+	matches := re.FindAllStringSubmatchIndex(body, -1)
+	if matches == nil {
+		return body
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		scheme := ""
+		if m[6] >= 0 {
+			scheme = body[m[6]:m[7]]
+		}
+
+		b.WriteString(body[last:m[8]]) // everything up to the credentials
+		b.WriteString(maskCredentials(scheme, body[m[8]:m[9]]))
+		last = m[9]
+	}
+	b.WriteString(body[last:])
+
+	return b.String()
+}
+
+// maskCredentials - Returns the masked credentials of a scheme ("" if the scheme wasn't kept)
+func maskCredentials(scheme, credentials string) string {
+	if strings.EqualFold(strings.TrimSpace(scheme), "Digest") {
+		return digestSecrets.ReplaceAllString(credentials, `${1}"`+Mask+`"`)
+	}
+
+	return Mask
+}
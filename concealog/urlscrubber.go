@@ -0,0 +1,134 @@
+package concealog
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultQueryParams - The query / form parameters that commonly carry credentials
+var DefaultQueryParams = []string{
+	"access_token", "id_token", "refresh_token", "token",
+	"api_key", "apikey", "client_secret", "password", "signature",
+}
+
+// urlTokens - Matches the URLs and request targets in a text, ie. the tokens with a scheme or a query string
+var urlTokens = regexp.MustCompile(`[^\s"'<>]*(?:://|\?)[^\s"'<>]*`)
+
+// URLScrubber - Masks the credentials in URLs: their userinfo, and the values of sensitive query parameters.
+// The rest of a URL is left exactly as it was encoded. The zero value masks the DefaultQueryParams.
+type URLScrubber struct {
+	Params []string // optional. The query parameters to mask, case-insensitive. Defaults to DefaultQueryParams.
+}
+
+// ScrubURL - Returns a copy of the URL, with its userinfo and sensitive query parameters masked.
+// The username is kept if there's a password, since the password is the secret then.
+func (s *URLScrubber) ScrubURL(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+
+	scrubbed := *u
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			scrubbed.User = url.UserPassword(u.User.Username(), Mask)
+		} else {
+			scrubbed.User = url.User(Mask)
+		}
+	}
+
+	scrubbed.RawQuery = s.scrubQuery(u.RawQuery)
+	return &scrubbed
+}
+
+// ReplaceString - takes a text as input, eg. a request line, a request dump or a log line,
+// and masks the credentials of any URL or request target in it:
+// "GET /userdata?access_token=abc HTTP/1.1" becomes "GET /userdata?access_token=********* HTTP/1.1"
+func (s *URLScrubber) ReplaceString(text string) string {
+	return urlTokens.ReplaceAllStringFunc(text, s.scrubRawURL)
+}
+
+// scrubRawURL - Masks the userinfo and sensitive query parameters of a raw URL or request target
+func (s *URLScrubber) scrubRawURL(raw string) string {
+	if scheme := strings.Index(raw, "://"); scheme >= 0 {
+		authority := raw[scheme+3:]
+		if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+			authority = authority[:end]
+		}
+
+		if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+			userinfo := Mask
+			if colon := strings.IndexByte(authority[:at], ':'); colon >= 0 {
+				userinfo = authority[:colon+1] + Mask
+			}
+			raw = raw[:scheme+3] + userinfo + raw[scheme+3+at:]
+		}
+	}
+
+	q := strings.IndexByte(raw, '?')
+	if q < 0 {
+		return raw
+	}
+
+	query, fragment := raw[q+1:], ""
+	if hash := strings.IndexByte(query, '#'); hash >= 0 {
+		query, fragment = query[:hash], query[hash:]
+	}
+
+	return raw[:q+1] + s.scrubQuery(query) + fragment
+}
+
+// scrubQuery - Masks the values of the sensitive parameters of a raw query, leaving the rest of it as it was encoded
+func (s *URLScrubber) scrubQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		eq := strings.IndexByte(pair, '=')
+		if eq < 0 {
+			continue
+		}
+
+		name := pair[:eq]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+
+		if s.sensitive(name) {
+			pairs[i] = pair[:eq+1] + Mask
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// scrubValues - Masks the values of the sensitive parameters of a parsed query or form
+func (s *URLScrubber) scrubValues(values url.Values) {
+	for name, v := range values {
+		if !s.sensitive(name) {
+			continue
+		}
+
+		for i := range v {
+			v[i] = Mask
+		}
+	}
+}
+
+// sensitive - Reports whether a query parameter is masked
+func (s *URLScrubber) sensitive(name string) bool {
+	params := s.Params
+	if params == nil {
+		params = DefaultQueryParams
+	}
+
+	for _, param := range params {
+		if strings.EqualFold(name, param) {
+			return true
+		}
+	}
+
+	return false
+}